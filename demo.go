@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+const (
+	demoSamples = 10000
+	demoSeed    = 42
+
+	// Parameters of the log-normal distribution: the median is e^mu ≈ 2.7,
+	// which fits the default linear buckets.
+	demoMu    = 1
+	demoSigma = 0.5
+)
+
+// demoInput returns a reproducible synthetic dataset of log-normally
+// distributed values, one per line, resembling request latencies.
+func demoInput() io.Reader {
+	rng := rand.New(rand.NewSource(demoSeed))
+
+	var b strings.Builder
+	for i := 0; i < demoSamples; i++ {
+		fmt.Fprintf(&b, "%.4f\n", math.Exp(demoMu+demoSigma*rng.NormFloat64()))
+	}
+	return strings.NewReader(b.String())
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+
+	"github.com/pstibrany/promfreq/histogram"
+)
+
+// config holds the command-line flags, and the values check derives from them.
+type config struct {
+	fs *flag.FlagSet
+
+	start               float64
+	factor              float64
+	width               float64
+	count               int
+	mode                string
+	columnWidth         int
+	totalWidth          int
+	explicitBounds      string
+	relativeError       float64
+	maxValue            float64
+	logBins             bool
+	boundsEpsilon       float64
+	bucketBound         string
+	integerBounds       bool
+	unit                string
+	sizeFormat          string
+	durationUnit        string
+	baseUnit            string
+	barChar             string
+	ascii               bool
+	precision           int
+	groupDigits         bool
+	alignCounts         bool
+	thousandsSep        string
+	decimalSep          string
+	delimiter           string
+	field               int
+	every               int
+	limit               int
+	sampleRate          float64
+	seed                int64
+	inputFormat         string
+	delta               bool
+	strictInput         bool
+	valueFrequency      bool
+	checkpointPath      string
+	checkpointEvery     int
+	resume              bool
+	colonValue          bool
+	weighted            bool
+	noAutoWeight        bool
+	gzipStdin           bool
+	comment             string
+	lenient             bool
+	filterExpr          string
+	overflowThreshold   float64
+	noWarn              bool
+	slowThreshold       float64
+	color               string
+	orientation         string
+	logScale            bool
+	invert              bool
+	hideEmpty           bool
+	normalize           string
+	cumulative          bool
+	runningPct          bool
+	bucketStats         bool
+	exact               bool
+	sortedInput         bool
+	maxBuffered         int
+	quantileMethod      string
+	duration            time.Duration
+	compact             bool
+	quiet               bool
+	trim                float64
+	extendedStats       bool
+	quantileList        string
+	validate            bool
+	validateTolerance   float64
+	percentileTable     bool
+	percentileStep      float64
+	output              string
+	title               string
+	metricName          string
+	compareFile         string
+	highlightCumulative float64
+
+	follow       bool
+	interval     time.Duration
+	flushEvery   int
+	printBuckets bool
+	helpModes    bool
+	demo         bool
+
+	number        numberParser // parses input values and -buckets
+	format        valueFormat  // formats bucket labels
+	summaryFormat valueFormat  // formats summary values, plain numbers if nil
+	quantiles     []float64
+	filter        *filter
+}
+
+// parseFlags parses the command-line arguments. On -help, it returns a nil
+// config and no error.
+func parseFlags(args []string, stderr io.Writer) (*config, error) {
+	c := &config{fs: flag.NewFlagSet(os.Args[0], flag.ContinueOnError)}
+	fs := c.fs
+	fs.SetOutput(stderr)
+
+	fs.Float64Var(&c.start, "start", 1, "Start value for linear or exponential buckets.")
+	fs.Float64Var(&c.factor, "factor", 5, "Factor used when computing exponential buckets.")
+	fs.Float64Var(&c.width, "width", 1, "Width of linear buckets")
+	fs.IntVar(&c.count, "count", 10, "Number of linear or exponential buckets")
+	fs.StringVar(&c.mode, "mode", "linear", "Linear, exponential, exponential-signed, auto or exponential-auto. The auto modes read all input into memory to choose the buckets, up to -max-buffered samples.")
+	fs.IntVar(&c.columnWidth, "column-width", 30, "Width of the largest bin. When writing to a terminal, bars fill its width unless this is set.")
+	fs.IntVar(&c.totalWidth, "total-width", 0, "Fit each line, including labels and counts, into this many columns. Overrides -column-width.")
+	fs.StringVar(&c.explicitBounds, "buckets", "", "Explicit buckets: comma separated bucket boundaries.")
+	fs.Float64Var(&c.relativeError, "relative-error", 0, "Use exponential buckets from -start to -max that guarantee this relative error of quantile estimates, e.g. 0.01.")
+	fs.Float64Var(&c.maxValue, "max", 0, "Largest value to cover with -relative-error buckets.")
+	fs.BoolVar(&c.logBins, "log-bins", false, "Use buckets of equal width in log10 space: -start is the first boundary, -width is in decades.")
+	fs.Float64Var(&c.boundsEpsilon, "bounds-epsilon", 1e-9, "Merge bucket boundaries closer than this fraction of their magnitude. Equal boundaries are always merged.")
+	fs.StringVar(&c.bucketBound, "bucket-bound", "le", "Whether buckets hold samples up to and including their upper bound, le as in Prometheus, or only below it, lt.")
+	fs.BoolVar(&c.integerBounds, "integer-bounds", false, "Round bucket boundaries to integers.")
+	fs.StringVar(&c.unit, "unit", "", "Unit of input values and -buckets: empty for plain numbers, duration for values like 250ms or 1.5s, or bytes for sizes like 512KiB or 1.5MB.")
+	fs.StringVar(&c.sizeFormat, "size-format", "", "With -unit bytes, show labels and summary values with iec (KiB, MiB, ...) or si (KB, MB, ...) suffixes. Empty shows plain byte counts.")
+	fs.StringVar(&c.durationUnit, "duration-unit", "s", "With -unit duration, the unit samples are converted to: ns, us, ms, s, m or h. Plain numbers are taken to be in this unit.")
+	fs.StringVar(&c.baseUnit, "base-unit", "", "Unit of duration values (ns, us, ms or s). Labels are then scaled to the most readable unit.")
+	fs.StringVar(&c.barChar, "bar-char", "", "Draw bars by repeating this character, e.g. = or *, instead of blocks with eighths. Bar lengths are then rounded to whole characters.")
+	fs.BoolVar(&c.ascii, "ascii", false, "Draw bars, labels and table borders with ASCII characters only, for terminals without Unicode support.")
+	fs.IntVar(&c.precision, "precision", 0, "Significant digits of bucket labels and summary values. 0 uses 6 digits for labels and as many as needed in the summary.")
+	fs.BoolVar(&c.groupDigits, "group-digits", false, "Separate thousands in bucket counts with commas, e.g. 1,234,567.")
+	fs.BoolVar(&c.alignCounts, "align-counts", true, "Right-justify count and percent columns to a common width, so that they line up. -align-counts=false puts them right after each bar.")
+	fs.StringVar(&c.thousandsSep, "thousands-sep", "", "Thousands separator in input values, e.g. , for 1,234.5. Empty if values are not grouped.")
+	fs.StringVar(&c.decimalSep, "decimal-sep", ".", "Decimal separator in input values, e.g. , for 1.234,5 with -thousands-sep .")
+	fs.StringVar(&c.delimiter, "delimiter", "", "Field delimiter used with -field and -filter. Defaults to whitespace.")
+	fs.IntVar(&c.field, "field", 0, "1-based field holding the value. Defaults to the whole line.")
+	fs.IntVar(&c.every, "every", 1, "Only use every Nth line of input, for a quick preview of large inputs.")
+	fs.IntVar(&c.limit, "limit", 0, "Stop reading after this many samples. 0 means no limit.")
+	fs.Float64Var(&c.sampleRate, "sample-rate", 1, "Use each line of input with this probability, e.g. 0.01, for a quick preview of large inputs.")
+	fs.Int64Var(&c.seed, "seed", 0, "Seed of the random choice of lines by -sample-rate, to make it reproducible. Random if not set.")
+	fs.StringVar(&c.inputFormat, "input", "samples", "Input format: samples, one per line, or prometheus for a histogram in the Prometheus text exposition format.")
+	fs.BoolVar(&c.delta, "delta", false, "With -input prometheus and two files, scrapes of the same histogram, show the samples observed between the first and the second, e.g. for the p99 of a scrape interval.")
+	fs.BoolVar(&c.strictInput, "strict-monotonic-input", false, "With -input prometheus, fail when name_count differs from the +Inf bucket instead of warning. Decreasing bucket counts are always an error.")
+	fs.BoolVar(&c.valueFrequency, "value-frequency", false, "Histogram how many times each distinct value occurs, instead of the values. Keeps distinct values in memory.")
+	fs.StringVar(&c.checkpointPath, "checkpoint", "", "Periodically save the aggregated state to this file.")
+	fs.IntVar(&c.checkpointEvery, "checkpoint-every", 100000, "Number of samples between checkpoints.")
+	fs.BoolVar(&c.resume, "resume", false, "Continue from the state saved in the -checkpoint file.")
+	fs.BoolVar(&c.colonValue, "colon-value", false, "Parse the value after the last colon, for lines like name:0.25.")
+	fs.BoolVar(&c.weighted, "weighted", false, "Each line holds a value and the integer number of times it occurred, separated by whitespace or -delimiter.")
+	fs.BoolVar(&c.noAutoWeight, "no-auto-weight", false, "Don't treat input with two numeric columns as \"value weight\" pairs.")
+	fs.BoolVar(&c.gzipStdin, "gzip", false, "Decompress gzip-compressed stdin. Files ending in .gz are always decompressed.")
+	fs.StringVar(&c.comment, "comment", "#", "Skip lines starting with this prefix. Blank lines are always skipped.")
+	fs.BoolVar(&c.lenient, "lenient", false, "Skip lines that cannot be parsed instead of failing.")
+	fs.StringVar(&c.filterExpr, "filter", "", "Only use lines matching a predicate on a field, e.g. col3==200. Supports ==, !=, < and >.")
+	fs.Float64Var(&c.overflowThreshold, "overflow-threshold", 0.01, "Warn when more than this fraction of samples is above the largest bucket boundary.")
+	fs.BoolVar(&c.noWarn, "no-warn", false, "Don't warn about samples above the largest bucket boundary.")
+	fs.Float64Var(&c.slowThreshold, "slow-threshold", 0, "Report how many samples exceed this value.")
+	fs.StringVar(&c.color, "color", "auto", "Color bars by length: auto colors only when writing to a terminal, always or never.")
+	fs.StringVar(&c.orientation, "orientation", "horizontal", "Bar orientation: horizontal, or vertical with a column per bucket and -column-width as the height.")
+	fs.BoolVar(&c.logScale, "log-scale", false, "With -orientation vertical, make bar heights logarithmic and label the axis with powers of ten.")
+	fs.BoolVar(&c.invert, "invert", false, "With -orientation vertical, draw the axis at the top and the bars hanging down from it.")
+	fs.BoolVar(&c.hideEmpty, "hide-empty", false, "Leave out buckets without samples.")
+	fs.StringVar(&c.normalize, "normalize", "max", "Scale bars to the fullest bucket with max, or to all samples with total: a full-width bar then holds all samples, and bars of different runs compare.")
+	fs.BoolVar(&c.cumulative, "cumulative", false, "Show the cumulative number and percentage of samples up to each bucket's upper bound, instead of those in each bucket.")
+	fs.BoolVar(&c.runningPct, "running-percent", false, "Show the cumulative percentage of samples up to each bucket.")
+	fs.BoolVar(&c.bucketStats, "bucket-stats", false, "Show min, mean and max of the samples in each bucket.")
+	fs.BoolVar(&c.exact, "exact", false, "Compute exact quantiles. Keeps all samples in memory.")
+	fs.BoolVar(&c.sortedInput, "sorted-input", false, "Input is sorted in ascending order, e.g. by sort -n, so -exact doesn't need to sort it. Unsorted input is an error.")
+	fs.IntVar(&c.maxBuffered, "max-buffered", 0, "With -exact, keep at most this many samples and estimate quantiles from a random sample of them beyond that. In the auto modes, choose the buckets from the first this many samples. 0 means no limit.")
+	fs.StringVar(&c.quantileMethod, "quantile-method", "interpolate", "How quantiles are picked within the bucket they fall into: interpolate, or the bucket's lower or higher bound, the nearest bound or the midpoint. With -exact, the same between neighbouring samples, as in NumPy. linear is the same as interpolate.")
+	fs.DurationVar(&c.duration, "duration", 0, "Time span the input was collected over, e.g. 60s. Counts are then shown as rates per second.")
+	fs.BoolVar(&c.compact, "compact", false, "Print only the summary, on a single line.")
+	fs.BoolVar(&c.quiet, "quiet", false, "Print only the summary, without the histogram.")
+	fs.Float64Var(&c.trim, "trim", 0, "Report the mean without the lowest and highest fraction of samples, e.g. 0.05, as tmean. Estimated from the buckets.")
+	fs.BoolVar(&c.extendedStats, "extended-stats", false, "Include additional statistics in the summary.")
+	fs.StringVar(&c.quantileList, "quantiles", "0.5,0.9,0.95,0.99", "Comma-separated quantiles to report in the summary, each in (0, 1].")
+	fs.BoolVar(&c.validate, "validate", false, "Compare the quantiles estimated from the buckets with the exact ones, which are known with -exact or -mode auto.")
+	fs.Float64Var(&c.validateTolerance, "validate-tolerance", 0.05, "Mark estimated quantiles of -validate that are off by more than this fraction of the exact ones.")
+	fs.BoolVar(&c.percentileTable, "percentile-table", false, "Print a table of percentiles after the summary.")
+	fs.Float64Var(&c.percentileStep, "percentile-step", 1, "Granularity of the percentile table, in percent.")
+	fs.StringVar(&c.output, "output", "text", "Output format: text, ascii-table, json, prometheus, prometheus-summary or weighted.")
+	fs.StringVar(&c.title, "title", "", "Print this title above the histogram. Also written as the HELP of -output prometheus metrics and the title of -output json.")
+	fs.StringVar(&c.metricName, "metric-name", "promfreq", "Name of the histogram metric written by -output prometheus.")
+	fs.StringVar(&c.compareFile, "compare", "", "Compare the input with the samples in this file: both are bucketed with the same buckets and shown side by side, with the change of each bucket.")
+	fs.Float64Var(&c.highlightCumulative, "highlight-cumulative", 0, "Mark the first bucket where the cumulative percentage reaches this value (0 disables).")
+
+	fs.BoolVar(&c.follow, "follow", false, "Keep reading the last input file as it grows, like tail -f, and redraw the histogram every -interval. Without a terminal, snapshots are appended instead.")
+	fs.DurationVar(&c.interval, "interval", time.Second, "Time between redraws with -follow.")
+	fs.IntVar(&c.flushEvery, "flush-every", 0, "Redraw the histogram every N samples while reading, when writing to a terminal.")
+	fs.BoolVar(&c.printBuckets, "print-buckets", false, "Print the bucket boundaries, one per line, and exit without reading input.")
+	fs.BoolVar(&c.helpModes, "help-modes", false, "Explain the bucketing modes and exit.")
+	fs.BoolVar(&c.demo, "demo", false, "Render a built-in synthetic dataset instead of reading input.")
+
+	fs.Usage = func() { usage(fs) }
+	if err := setFlagsFromEnv(fs); err != nil {
+		return nil, fail(exitUsage, err)
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil, nil
+	} else if err != nil {
+		// The flag package has printed the error and the usage already.
+		return nil, &exitCodeError{code: exitUsage}
+	}
+	return c, nil
+}
+
+// check validates the flags and their combinations, and derives the parsers
+// and formats they select.
+func (c *config) check() error {
+	switch c.output {
+	case "text", "ascii-table", "json", "prometheus", "prometheus-summary", "weighted":
+	default:
+		return fail(exitUsage, "Unknown output format:", c.output)
+	}
+
+	switch c.orientation {
+	case "horizontal", "vertical":
+	default:
+		return fail(exitUsage, "Unknown orientation:", c.orientation)
+	}
+	if (c.invert || c.logScale) && c.orientation != "vertical" {
+		return fail(exitUsage, "-invert and -log-scale need -orientation vertical")
+	}
+
+	switch c.bucketBound {
+	case "le":
+	case "lt":
+		if c.inputFormat == "prometheus" || c.output == "prometheus" {
+			return fail(exitUsage, "-bucket-bound lt cannot be used with Prometheus histograms, whose buckets are le")
+		}
+	default:
+		return fail(exitUsage, "Unknown bucket bound:", c.bucketBound)
+	}
+
+	if c.follow {
+		if c.interval <= 0 {
+			return fail(exitUsage, "Interval must be positive, got:", c.interval)
+		}
+		if c.inputFormat == "prometheus" || c.valueFrequency || c.mode == "auto" || c.mode == "exponential-auto" || c.flushEvery > 0 {
+			return fail(exitUsage, "-follow cannot be used with -input prometheus, -value-frequency, the auto modes or -flush-every")
+		}
+	}
+
+	switch c.normalize {
+	case "max", "total":
+	default:
+		return fail(exitUsage, "Unknown normalization:", c.normalize)
+	}
+
+	switch c.color {
+	case "auto", "always", "never":
+	default:
+		return fail(exitUsage, "Unknown color mode:", c.color)
+	}
+
+	switch c.inputFormat {
+	case "samples":
+	case "prometheus":
+		// Exposition data carries only the buckets, sum and count.
+		if c.exact || c.valueFrequency || c.checkpointPath != "" || isFlagSet(c.fs, "slow-threshold") || c.bucketStats {
+			return fail(exitUsage, "-input prometheus cannot be used with -exact, -value-frequency, -checkpoint, -slow-threshold or -bucket-stats")
+		}
+	default:
+		return fail(exitUsage, "Unknown input format:", c.inputFormat)
+	}
+	if c.strictInput && c.inputFormat != "prometheus" {
+		return fail(exitUsage, "-strict-monotonic-input needs -input prometheus")
+	}
+	if c.delta && (c.inputFormat != "prometheus" || c.fs.NArg() != 2) {
+		return fail(exitUsage, "-delta needs -input prometheus and two files")
+	}
+
+	if c.compareFile != "" {
+		if c.output != "text" || c.orientation != "horizontal" {
+			return fail(exitUsage, "-compare needs -output text and -orientation horizontal")
+		}
+		if c.inputFormat != "samples" || c.valueFrequency {
+			return fail(exitUsage, "-compare cannot be used with -input prometheus or -value-frequency")
+		}
+	}
+
+	if c.barChar != "" && (utf8.RuneCountInString(c.barChar) != 1 || runewidth.StringWidth(c.barChar) < 1) {
+		return fail(exitUsage, "Bar character must be a single printable character, got:", c.barChar)
+	}
+
+	if !metricNameRegexp.MatchString(c.metricName) {
+		return fail(exitUsage, "Invalid metric name:", c.metricName)
+	}
+
+	c.number = parsePlain
+	switch c.unit {
+	case "":
+	case "duration":
+		var err error
+		if c.number, err = durationParser(c.durationUnit); err != nil {
+			return fail(exitUsage, err)
+		}
+		// Show labels as durations too, unless asked otherwise.
+		if c.baseUnit == "" {
+			c.baseUnit = c.durationUnit
+		}
+	case "bytes":
+		c.number = parseBytes
+	default:
+		return fail(exitUsage, "Unknown unit:", c.unit)
+	}
+
+	if c.decimalSep == "" || c.thousandsSep == c.decimalSep {
+		return fail(exitUsage, "-decimal-sep must be set and differ from -thousands-sep")
+	}
+	if c.delimiter != "" && (c.delimiter == c.thousandsSep || c.delimiter == c.decimalSep) {
+		return fail(exitUsage, "-delimiter cannot be the same as -thousands-sep or -decimal-sep")
+	}
+	if c.weighted && c.field > 0 {
+		return fail(exitUsage, "-weighted cannot be used with -field, the value is always the first field")
+	}
+
+	if c.precision < 0 {
+		return fail(exitUsage, "Precision must not be negative, got:", c.precision)
+	}
+	if c.columnWidth < 0 || c.totalWidth < 0 {
+		return fail(exitUsage, "-column-width and -total-width must not be negative")
+	}
+	labelDigits := 6
+	if c.precision > 0 {
+		labelDigits = c.precision
+	}
+
+	c.format = plainFormat(labelDigits)
+	if c.baseUnit != "" {
+		var err error
+		if c.format, err = durationFormat(c.baseUnit, labelDigits); err != nil {
+			return fail(exitUsage, err)
+		}
+	}
+
+	switch c.sizeFormat {
+	case "":
+	case "iec", "si":
+		if c.unit != "bytes" {
+			return fail(exitUsage, "-size-format needs -unit bytes")
+		}
+		summaryDigits := -1
+		if c.precision > 0 {
+			summaryDigits = c.precision
+		}
+		c.format = bytesFormat(c.sizeFormat == "si", labelDigits)
+		c.summaryFormat = bytesFormat(c.sizeFormat == "si", summaryDigits)
+	default:
+		return fail(exitUsage, "Unknown size format:", c.sizeFormat)
+	}
+
+	if err := histogram.ValidateQuantileMethod(c.quantileMethod); err != nil {
+		return fail(exitUsage, err)
+	}
+
+	var err error
+	if c.quantiles, err = parseQuantiles(c.quantileList); err != nil {
+		return fail(exitUsage, err)
+	}
+
+	if c.trim < 0 || c.trim >= 0.5 {
+		return fail(exitUsage, "Trim must be at least 0 and less than 0.5, got:", c.trim)
+	}
+
+	if !(c.sampleRate > 0 && c.sampleRate <= 1) {
+		return fail(exitUsage, "Sample rate must be in (0, 1], got:", c.sampleRate)
+	}
+	if c.limit < 0 {
+		return fail(exitUsage, "Limit must not be negative, got:", c.limit)
+	}
+
+	if c.percentileStep <= 0 || c.percentileStep >= 100 {
+		return fail(exitUsage, "Percentile step must be between 0 and 100, got:", c.percentileStep)
+	}
+
+	if c.autoMode() && (c.valueFrequency || c.checkpointPath != "") {
+		return fail(exitUsage, "-mode", c.mode, "cannot be used with -value-frequency or -checkpoint")
+	}
+	if c.printBuckets && (c.autoMode() || c.inputFormat == "prometheus") {
+		return fail(exitUsage, "-print-buckets cannot be used when buckets come from the input")
+	}
+
+	if c.checkpointPath != "" {
+		if c.valueFrequency {
+			return fail(exitUsage, "-checkpoint cannot be used with -value-frequency")
+		}
+		// Checkpoints hold the buckets and statistics, not retained samples.
+		if c.exact || c.sortedInput || c.maxBuffered > 0 {
+			return fail(exitUsage, "-checkpoint cannot be used with -exact, -sorted-input or -max-buffered")
+		}
+		if c.checkpointEvery < 1 {
+			return fail(exitUsage, "-checkpoint-every needs a positive number of samples")
+		}
+	} else if c.resume {
+		return fail(exitUsage, "-resume needs -checkpoint")
+	}
+
+	if c.filterExpr != "" {
+		if c.filter, err = parseFilter(c.filterExpr); err != nil {
+			return fail(exitUsage, "Invalid filter:", err)
+		}
+	}
+	return nil
+}
@@ -4,4 +4,5 @@ go 1.13
 
 require (
 	github.com/mattn/go-runewidth v0.0.4
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
@@ -0,0 +1,256 @@
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseBucketBoundaries parses comma separated bucket boundaries, which may be
+// given in any order. Boundaries must be finite and distinct; errors quote the
+// list as given, so the offending entry can be found.
+func ParseBucketBoundaries(inp string, number func(string) (float64, error)) ([]float64, error) {
+	s := strings.Split(inp, ",")
+
+	result := make([]float64, 0, len(s))
+	for _, b := range s {
+		v, err := number(b)
+		if err != nil {
+			return nil, fmt.Errorf("non-numeric input: %q", b)
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("bucket boundary %q in %q is not a finite number", b, inp)
+		}
+		result = append(result, v)
+	}
+
+	sort.Float64s(result)
+	for ix := 1; ix < len(result); ix++ {
+		if result[ix] == result[ix-1] {
+			return nil, fmt.Errorf("duplicate bucket boundary %g in %q", result[ix], inp)
+		}
+	}
+	return result, nil
+}
+
+// LinearBuckets returns count bucket boundaries, starting at start and width
+// apart.
+func LinearBuckets(start, width float64, count int) ([]float64, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("--linear-buckets needs a positive count")
+	}
+	buckets := make([]float64, count)
+	for i := range buckets {
+		// Multiply rather than accumulate, so that errors don't add up over many buckets.
+		buckets[i] = TrimFloatNoise(start + float64(i)*width)
+	}
+	return buckets, nil
+}
+
+// TrimFloatNoise rounds v to 15 significant digits, the precision a float64
+// reliably holds. This turns results like 0.30000000000000004 (3 * 0.1) into
+// the value the user meant.
+func TrimFloatNoise(v float64) float64 {
+	r, err := strconv.ParseFloat(strconv.FormatFloat(v, 'g', 15, 64), 64)
+	if err != nil {
+		return v
+	}
+	return r
+}
+
+// LogBuckets returns buckets that have equal width in log10 space, starting at
+// start. The width is given in decades, so a width of 1 produces 1, 10, 100, ...
+// for start 1.
+func LogBuckets(start, width float64, count int) ([]float64, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("log buckets need a positive count")
+	}
+	if start <= 0 {
+		return nil, fmt.Errorf("log buckets need a positive start value")
+	}
+	if width <= 0 {
+		return nil, fmt.Errorf("log buckets need a positive width")
+	}
+	exp := math.Log10(start)
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = TrimFloatNoise(math.Pow(10, exp+float64(i)*width))
+	}
+	return buckets, nil
+}
+
+// ExponentialBuckets returns count bucket boundaries, starting at start, each
+// factor times the previous one.
+func ExponentialBuckets(start, factor float64, count int) ([]float64, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("exponential buckets need a positive count")
+	}
+	if start <= 0 {
+		return nil, fmt.Errorf("exponential buckets need a positive start value")
+	}
+	if factor <= 1 {
+		return nil, fmt.Errorf("exponential buckets need a factor greater than 1")
+	}
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets, nil
+}
+
+// SignedExponentialBuckets returns exponential buckets mirrored around zero:
+// -start*factor^(count-1), ..., -start, 0, start, ..., start*factor^(count-1).
+// Count is the number of positive boundaries.
+func SignedExponentialBuckets(start, factor float64, count int) ([]float64, error) {
+	positive, err := ExponentialBuckets(start, factor, count)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]float64, 0, 2*count+1)
+	for i := len(positive) - 1; i >= 0; i-- {
+		buckets = append(buckets, -positive[i])
+	}
+	buckets = append(buckets, 0)
+	return append(buckets, positive...), nil
+}
+
+// RelativeErrorBuckets returns exponential buckets covering start to max, such
+// that any value in a bucket is within relative error e of the bucket's
+// midpoint. This is the DDSketch construction: factor = (1+e)/(1-e).
+func RelativeErrorBuckets(start, max, e float64) ([]float64, error) {
+	if e <= 0 || e >= 1 {
+		return nil, fmt.Errorf("relative error must be between 0 and 1")
+	}
+	if start <= 0 {
+		return nil, fmt.Errorf("relative error buckets need a positive start value")
+	}
+	if max <= start {
+		return nil, fmt.Errorf("relative error buckets need a max value greater than start")
+	}
+	factor := (1 + e) / (1 - e)
+	count := int(math.Ceil(math.Log(max/start)/math.Log(factor))) + 1
+	return ExponentialBuckets(start, factor, count)
+}
+
+// maxAutoBuckets limits the number of buckets AutoBuckets creates, as the
+// Freedman–Diaconis rule asks for many narrow buckets on long-tailed data.
+const maxAutoBuckets = 100
+
+// AutoBuckets returns linear buckets covering the samples. The bucket width
+// follows the Freedman–Diaconis rule, 2*IQR/n^(1/3), or Sturges' rule of
+// log2(n)+1 buckets for small inputs and inputs with an IQR of 0. The width is
+// then rounded to 1, 2 or 5 times a power of ten, so that the boundaries are
+// round numbers. The samples are sorted in place.
+func AutoBuckets(samples []WeightedSample) ([]float64, error) {
+	n := float64(0)
+	for _, s := range samples {
+		n += s.Weight
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	SortSamples(samples)
+	min, max := samples[0].Value, samples[len(samples)-1].Value
+	if min == max {
+		return []float64{min}, nil
+	}
+
+	iqr := ExactQuantile(0.75, samples, n, "linear") - ExactQuantile(0.25, samples, n, "linear")
+
+	var width float64
+	if n >= 30 && iqr > 0 {
+		width = 2 * iqr / math.Cbrt(n)
+	} else {
+		width = (max - min) / (math.Ceil(math.Log2(n)) + 1)
+	}
+	width = math.Max(roundWidth(width, false), roundWidth((max-min)/maxAutoBuckets, true))
+
+	first := math.Floor(min/width) * width
+	return LinearBuckets(first+width, width, int(math.Ceil((max-first)/width)))
+}
+
+// ExponentialAutoBuckets returns count exponential buckets spanning the
+// samples, from the smallest to the largest one, with a factor of
+// (max/min)^(1/count). The smallest sample is the first boundary, so it is
+// alone in the lowest bucket. Samples must be positive.
+func ExponentialAutoBuckets(samples []WeightedSample, count int) ([]float64, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("exponential buckets need a positive count")
+	}
+	if len(samples) == 0 {
+		return nil, nil
+	}
+
+	min, max := samples[0].Value, samples[0].Value
+	for _, s := range samples {
+		min, max = math.Min(min, s.Value), math.Max(max, s.Value)
+	}
+	if min <= 0 {
+		return nil, fmt.Errorf("exponential buckets need positive samples, the smallest is %g", min)
+	}
+	if min == max {
+		return []float64{min}, nil
+	}
+
+	buckets, err := ExponentialBuckets(min, math.Pow(max/min, 1/float64(count)), count+1)
+	if err != nil {
+		return nil, err
+	}
+	// Rounding errors must not leave the largest sample above the last bound.
+	buckets[count] = max
+	return buckets, nil
+}
+
+// roundWidth rounds w to the nearest of 1, 2 or 5 times a power of ten, by
+// ratio. If up is set, it rounds up to the next one instead.
+func roundWidth(w float64, up bool) float64 {
+	scale := math.Pow(10, math.Floor(math.Log10(w)))
+	best := 10 * scale
+	for _, f := range []float64{5, 2, 1} {
+		c := f * scale
+		if up && c >= w || !up && math.Abs(math.Log(c/w)) < math.Abs(math.Log(best/w)) {
+			best = c
+		}
+	}
+	return TrimFloatNoise(best)
+}
+
+// RoundBuckets rounds sorted bucket boundaries to integers. Boundaries that
+// become equal after rounding are merged.
+func RoundBuckets(buckets []float64) []float64 {
+	result := make([]float64, 0, len(buckets))
+	for _, b := range buckets {
+		r := math.Round(b)
+		if len(result) > 0 && result[len(result)-1] == r {
+			continue
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// MergeCloseBuckets drops sorted bucket boundaries that are within epsilon of
+// the preceding kept boundary. Such buckets have near-zero width and only
+// confuse the output. Epsilon is relative to the larger of the two boundaries
+// in magnitude, so that tiny boundaries aren't merged just for being tiny.
+// Equal boundaries are always merged. Returns the kept boundaries and the
+// pairs of (kept, dropped) boundaries.
+func MergeCloseBuckets(buckets []float64, epsilon float64) (result []float64, merged [][2]float64) {
+	result = make([]float64, 0, len(buckets))
+	for _, b := range buckets {
+		if len(result) > 0 {
+			last := result[len(result)-1]
+			if b-last <= epsilon*math.Max(math.Abs(last), math.Abs(b)) {
+				merged = append(merged, [2]float64{last, b})
+				continue
+			}
+		}
+		result = append(result, b)
+	}
+	return result, merged
+}
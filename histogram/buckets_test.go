@@ -0,0 +1,57 @@
+package histogram
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func parseFloat(s string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSpace(s), 64)
+}
+
+func TestParseBucketBoundariesRejectsInvalid(t *testing.T) {
+	for _, inp := range []string{"1,1,2", "1,NaN,3", "2,1,2"} {
+		_, err := ParseBucketBoundaries(inp, parseFloat)
+		if err == nil {
+			t.Errorf("%q: expected an error", inp)
+			continue
+		}
+		// The list is quoted as given, not sorted.
+		if !strings.Contains(err.Error(), strconv.Quote(inp)) {
+			t.Errorf("%q: error doesn't quote the input: %v", inp, err)
+		}
+	}
+
+	got, err := ParseBucketBoundaries("3,1,2", parseFloat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("got %v, want [1 2 3]", got)
+	}
+}
+
+func TestLinearBucketsExact(t *testing.T) {
+	got, err := LinearBuckets(0, 0.1, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := got[len(got)-1]; last != 99.9 {
+		t.Errorf("last boundary is %v, want 99.9", last)
+	}
+}
+
+func TestLinearBucketsNoDrift(t *testing.T) {
+	// Accumulating 0.1 would give 0.30000000000000004 and so on.
+	got, err := LinearBuckets(0, 0.1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{0, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9}
+	for ix := range want {
+		if got[ix] != want[ix] {
+			t.Errorf("boundary %d is %v, want %v", ix, got[ix], want[ix])
+		}
+	}
+}
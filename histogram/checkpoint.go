@@ -0,0 +1,111 @@
+package histogram
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// checkpoint is the serialized state of a histogram, used to resume long
+// running aggregations. Retained samples of exact mode are not included, so a
+// histogram that retains samples cannot be resumed faithfully.
+type checkpoint struct {
+	Bounds  []float64          `json:"bounds"`
+	Buckets []checkpointBucket `json:"buckets"`
+
+	Sum   float64 `json:"sum"`
+	Count float64 `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	M2    float64 `json:"m2"`
+	Slow  float64 `json:"slow"`
+
+	LogSum        float64 `json:"log_sum"`
+	ReciprocalSum float64 `json:"reciprocal_sum"`
+	Positive      float64 `json:"positive"`
+	NonPositive   float64 `json:"non_positive"`
+}
+
+type checkpointBucket struct {
+	Count float64 `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Sum   float64 `json:"sum"`
+}
+
+// SaveCheckpoint writes the state of the histogram to path. The file is
+// replaced atomically, so a crash never leaves a partial checkpoint behind.
+func SaveCheckpoint(path string, h *Histogram) error {
+	c := checkpoint{
+		Bounds: h.Bounds,
+		Sum:    h.Sum,
+		Count:  h.Count,
+		Min:    h.Min,
+		Max:    h.Max,
+		Mean:   h.mean,
+		M2:     h.m2,
+		Slow:   h.Slow,
+
+		LogSum:        h.logSum,
+		ReciprocalSum: h.reciprocalSum,
+		Positive:      h.positive,
+		NonPositive:   h.NonPositive,
+	}
+	for _, b := range h.Buckets {
+		c.Buckets = append(c.Buckets, checkpointBucket{Count: b.Count, Min: b.Min, Max: b.Max, Sum: b.Sum})
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadCheckpoint restores the state of the histogram from path. The histogram
+// must use the same bucket boundaries as the checkpoint.
+func LoadCheckpoint(path string, h *Histogram) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var c checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return fmt.Errorf("invalid checkpoint %s: %v", path, err)
+	}
+
+	if !equalBounds(c.Bounds, h.Bounds) || len(c.Buckets) != len(h.Buckets) {
+		return fmt.Errorf("checkpoint %s was written with different buckets", path)
+	}
+
+	for ix, b := range c.Buckets {
+		h.Buckets[ix].Count = b.Count
+		h.Buckets[ix].Min = b.Min
+		h.Buckets[ix].Max = b.Max
+		h.Buckets[ix].Sum = b.Sum
+	}
+	h.Sum, h.Count, h.Min, h.Max = c.Sum, c.Count, c.Min, c.Max
+	h.mean, h.m2, h.Slow = c.Mean, c.M2, c.Slow
+	h.logSum, h.reciprocalSum, h.positive, h.NonPositive = c.LogSum, c.ReciprocalSum, c.Positive, c.NonPositive
+	return nil
+}
+
+func equalBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
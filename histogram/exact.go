@@ -0,0 +1,82 @@
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// WeightedSample is a sample retained for computing exact quantiles.
+type WeightedSample struct {
+	Value, Weight float64
+}
+
+// QuantileMethods are the interpolation methods supported by ExactQuantile
+// and BucketQuantile. They match the methods of the same name in NumPy's
+// percentile function, interpolate being another name for linear.
+var QuantileMethods = []string{"interpolate", "linear", "lower", "higher", "nearest", "midpoint"}
+
+// ValidateQuantileMethod returns an error unless method is one of
+// QuantileMethods.
+func ValidateQuantileMethod(method string) error {
+	for _, m := range QuantileMethods {
+		if m == method {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown quantile method %q", method)
+}
+
+// ExactQuantile calculates quantile q of the samples, which must be sorted by
+// value. Weighted samples count as weight copies of the value. With n
+// samples, q falls at index (n-1)*q of the sorted samples. If that isn't a
+// whole number, the method decides between the neighbouring samples i and j:
+//
+//	linear:   interpolate linearly between i and j (NumPy's default), also
+//	          called interpolate
+//	lower:    sample i
+//	higher:   sample j
+//	nearest:  whichever is nearer, rounding half to even
+//	midpoint: the mean of i and j
+//
+// If there are no samples, NaN is returned.
+func ExactQuantile(q float64, samples []WeightedSample, total float64, method string) float64 {
+	if len(samples) == 0 || total == 0 {
+		return math.NaN()
+	}
+
+	pos := (total - 1) * q
+	lower, upper := math.Floor(pos), math.Ceil(pos)
+
+	switch method {
+	case "lower":
+		return sampleAt(samples, lower)
+	case "higher":
+		return sampleAt(samples, upper)
+	case "nearest":
+		return sampleAt(samples, math.RoundToEven(pos))
+	case "midpoint":
+		return (sampleAt(samples, lower) + sampleAt(samples, upper)) / 2
+	default:
+		lo, hi := sampleAt(samples, lower), sampleAt(samples, upper)
+		return lo + (hi-lo)*(pos-lower)
+	}
+}
+
+// sampleAt returns the sample at index ix of the sorted samples, as if every
+// sample was repeated weight times.
+func sampleAt(samples []WeightedSample, ix float64) float64 {
+	seen := float64(0)
+	for _, s := range samples {
+		seen += s.Weight
+		if ix < seen {
+			return s.Value
+		}
+	}
+	return samples[len(samples)-1].Value
+}
+
+// SortSamples sorts the samples by value.
+func SortSamples(samples []WeightedSample) {
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Value < samples[j].Value })
+}
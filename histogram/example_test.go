@@ -0,0 +1,35 @@
+package histogram_test
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pstibrany/promfreq/histogram"
+)
+
+func ExampleRead() {
+	bounds, err := histogram.LinearBuckets(1, 1, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	input := "# latencies\r\n0.5\r\n1.5\r\n\r\n2.5\r3.5\n4.5\n"
+	h, err := histogram.Read(strings.NewReader(input), bounds)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Bucket counts are cumulative, as in Prometheus.
+	for _, b := range h.Buckets {
+		fmt.Printf("le=%g count=%g\n", b.UpperBound, b.Count)
+	}
+	fmt.Printf("count=%g avg=%g p50=%g\n", h.Count, h.Mean(), h.Quantile(0.5))
+	// Output:
+	// le=1 count=1
+	// le=2 count=2
+	// le=3 count=3
+	// le=4 count=4
+	// le=+Inf count=5
+	// count=5 avg=2.5 p50=2.5
+}
@@ -0,0 +1,358 @@
+// Package histogram implements the bucketing and quantile estimation of
+// promfreq, so that it can be used from Go programs. For example:
+//
+//	bounds, _ := histogram.ExponentialBuckets(0.001, 2, 16)
+//	h, err := histogram.Read(os.Stdin, bounds)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	fmt.Println(h.Count, h.Quantile(0.99))
+package histogram
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Histogram accumulates samples into cumulative buckets, the same way a
+// Prometheus histogram does, along with the summary statistics.
+type Histogram struct {
+	Bounds  []float64 // sorted upper bounds of the finite buckets
+	Buckets []Bucket  // cumulative counts, the last bucket is +Inf
+
+	// If LessThan is set, a sample equal to a bound is counted in the next
+	// bucket, so that buckets hold samples less than their upper bound rather
+	// than less than or equal to it, as in Prometheus.
+	LessThan bool
+
+	Sum, Count, Min, Max float64
+
+	// Running mean and sum of squared deviations (Welford's algorithm).
+	mean, m2 float64
+
+	// Sums of logarithms and reciprocals of the positive samples, for the
+	// geometric and harmonic means, and the number of such samples. Other
+	// samples are counted in NonPositive.
+	logSum, reciprocalSum, positive float64
+	NonPositive                     float64
+
+	// If Exact is set, all samples are retained and quantiles are computed
+	// from them instead of being estimated from buckets. Either way,
+	// QuantileMethod decides how, see ExactQuantile and BucketQuantile.
+	Exact          bool
+	QuantileMethod string
+	samples        []WeightedSample
+	retained       float64 // total weight of samples
+	sorted         bool
+	Presorted      bool // samples are observed in ascending order
+
+	// If MaxBuffered is positive, at most that many samples are retained.
+	// Once the limit is reached, samples are replaced using reservoir
+	// sampling, and quantiles become approximate.
+	MaxBuffered int
+	Seen        int // samples offered to the reservoir
+	Capped      bool
+	rng         *rand.Rand
+
+	// If TrackSlow is set, samples above SlowThreshold are counted in Slow.
+	TrackSlow     bool
+	SlowThreshold float64
+	Slow          float64
+}
+
+// New creates an empty histogram. One extra bucket for values larger
+// than the last bound is created. Bounds must be sorted and distinct, as
+// returned by ParseBucketBoundaries and the other bucket functions.
+func New(bounds []float64) *Histogram {
+	buckets := make([]Bucket, len(bounds)+1)
+	for ix := 0; ix < len(bounds); ix++ {
+		buckets[ix].UpperBound = bounds[ix]
+	}
+	buckets[len(bounds)].UpperBound = math.Inf(1)
+
+	return &Histogram{Bounds: bounds, Buckets: buckets}
+}
+
+// Read creates a histogram with the given bounds from samples read from r, one
+// per line, with any line ending. Blank lines and lines starting with # are
+// skipped.
+func Read(r io.Reader, bounds []float64) (*Histogram, error) {
+	h := New(bounds)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(ScanLines)
+	for line := 1; scanner.Scan(); line++ {
+		v := strings.TrimSpace(scanner.Text())
+		if v == "" || strings.HasPrefix(v, "#") {
+			continue
+		}
+
+		sample, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: found non-numerical input: %s", line, v)
+		}
+		h.Observe(sample, 1)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ScanLines is a bufio.SplitFunc like bufio.ScanLines, except that it also
+// treats a lone carriage return as a line ending. Lines therefore never carry
+// a trailing \r, whether the input uses \n, \r\n or \r line endings.
+func ScanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		switch {
+		case data[i] == '\n':
+			return i + 1, data[:i], nil
+		case i+1 < len(data) && data[i+1] == '\n':
+			return i + 2, data[:i], nil
+		case i+1 < len(data) || atEOF:
+			return i + 1, data[:i], nil
+		}
+		// A \r at the end of the buffer may be followed by \n, read more.
+		return 0, nil, nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// FromCumulative creates a histogram from cumulative bucket counts, such as
+// those of a Prometheus histogram, without the samples that were counted.
+// There is one more count than bounds, for the +Inf bucket, and the counts
+// must not decrease. Since the samples are unknown, Min, Max, the variance
+// and the geometric and harmonic means are NaN.
+func FromCumulative(bounds, counts []float64, sum float64) (*Histogram, error) {
+	h := New(bounds)
+	if len(counts) != len(h.Buckets) {
+		return nil, fmt.Errorf("expected %d bucket counts, got %d", len(h.Buckets), len(counts))
+	}
+
+	for ix := range h.Buckets {
+		b := &h.Buckets[ix]
+		b.Count = counts[ix]
+		if ix > 0 && b.Count < h.Buckets[ix-1].Count {
+			return nil, fmt.Errorf("bucket counts are not cumulative: le=%g has fewer samples than le=%g", b.UpperBound, h.Buckets[ix-1].UpperBound)
+		}
+		b.Min, b.Max, b.Sum = math.NaN(), math.NaN(), math.NaN()
+	}
+
+	h.Count = h.Buckets[len(h.Buckets)-1].Count
+	h.Sum = sum
+	h.Min, h.Max = math.NaN(), math.NaN()
+	h.mean = sum / h.Count
+	h.m2 = math.NaN()
+	h.logSum, h.reciprocalSum = math.NaN(), math.NaN()
+	return h, nil
+}
+
+// Observe adds a sample to the histogram, counted weight times.
+func (h *Histogram) Observe(sample, weight float64) {
+	if weight == 0 {
+		return
+	}
+
+	if h.Count == 0 || sample < h.Min {
+		h.Min = sample
+	}
+	if h.Count == 0 || sample > h.Max {
+		h.Max = sample
+	}
+
+	first := sort.SearchFloat64s(h.Bounds, sample)
+	if h.LessThan {
+		first = sort.Search(len(h.Bounds), func(i int) bool { return h.Bounds[i] > sample })
+	}
+	h.observeInBucket(first, sample, weight)
+
+	// Increment all buckets where sample is <= upperBound.
+	for ix := first; ix < len(h.Buckets); ix++ {
+		h.Buckets[ix].Count += weight
+	}
+	if h.TrackSlow && sample > h.SlowThreshold {
+		h.Slow += weight
+	}
+	h.Sum += sample * weight
+	h.Count += weight
+
+	if h.Exact {
+		h.retain(WeightedSample{Value: sample, Weight: weight})
+	}
+
+	delta := sample - h.mean
+	h.mean += delta * weight / h.Count
+	h.m2 += weight * delta * (sample - h.mean)
+
+	if sample > 0 {
+		h.logSum += math.Log(sample) * weight
+		h.reciprocalSum += weight / sample
+		h.positive += weight
+	} else {
+		h.NonPositive += weight
+	}
+}
+
+// observeInBucket updates the per-bucket min, max and sum of the bucket the
+// sample falls into. It must be called before the counts are incremented.
+func (h *Histogram) observeInBucket(ix int, sample, weight float64) {
+	b := &h.Buckets[ix]
+
+	empty := b.Count == 0
+	if ix > 0 {
+		empty = b.Count == h.Buckets[ix-1].Count
+	}
+
+	if empty || sample < b.Min {
+		b.Min = sample
+	}
+	if empty || sample > b.Max {
+		b.Max = sample
+	}
+	b.Sum += sample * weight
+}
+
+// retain keeps the sample for exact quantiles, subject to maxBuffered.
+func (h *Histogram) retain(s WeightedSample) {
+	h.Seen++
+
+	if h.MaxBuffered <= 0 || len(h.samples) < h.MaxBuffered {
+		h.samples = append(h.samples, s)
+		h.retained += s.Weight
+		h.sorted = h.Presorted
+		return
+	}
+	h.sorted = false
+
+	// Reservoir sampling (algorithm R): keep the new sample with probability
+	// maxBuffered/seen, replacing a random retained one.
+	if h.rng == nil {
+		h.rng = rand.New(rand.NewSource(1))
+	}
+	h.Capped = true
+	if j := h.rng.Intn(h.Seen); j < len(h.samples) {
+		h.retained += s.Weight - h.samples[j].Weight
+		h.samples[j] = s
+	}
+}
+
+// Quantile returns quantile q of the observed samples, exactly if samples are
+// retained and estimated from buckets otherwise.
+func (h *Histogram) Quantile(q float64) float64 {
+	if !h.Exact {
+		// BucketQuantile sorts and merges the buckets in place.
+		buckets := append([]Bucket(nil), h.Buckets...)
+		return BucketQuantile(q, buckets, h.QuantileMethod)
+	}
+
+	if !h.sorted {
+		SortSamples(h.samples)
+		h.sorted = true
+	}
+	return ExactQuantile(q, h.samples, h.retained, h.QuantileMethod)
+}
+
+// Mean returns the mean of the samples.
+func (h *Histogram) Mean() float64 {
+	return h.mean
+}
+
+// GeoMean returns the geometric mean of the positive samples. Samples that are
+// zero or negative have no logarithm and are left out, see NonPositive.
+func (h *Histogram) GeoMean() float64 {
+	return math.Exp(h.logSum / h.positive)
+}
+
+// HarmonicMean returns the harmonic mean of the positive samples. Like
+// GeoMean, it leaves out samples that are zero or negative.
+func (h *Histogram) HarmonicMean() float64 {
+	return h.positive / h.reciprocalSum
+}
+
+// ModalBucket returns the index of the bucket with the most samples, the lowest
+// one if several have as many. If there are no samples, it returns -1.
+func (h *Histogram) ModalBucket() int {
+	modal, most, prev := -1, float64(0), float64(0)
+	for ix, b := range h.Buckets {
+		if n := b.Count - prev; n > most {
+			modal, most = ix, n
+		}
+		prev = b.Count
+	}
+	return modal
+}
+
+// TrimmedMean estimates the mean of the samples without the lowest and the
+// highest fraction p of them, from the buckets rather than the samples. Like
+// BucketQuantile, it assumes that samples are spread evenly within each
+// bucket, that the lowest bucket starts at 0 if its upper bound is positive,
+// and that samples in the +Inf bucket equal the highest finite bound. The
+// estimate is thus only as good as the buckets are narrow, and is too low if
+// the trimmed range reaches into the +Inf bucket.
+func (h *Histogram) TrimmedMean(p float64) float64 {
+	from, to := p*h.Count, (1-p)*h.Count
+	if len(h.Buckets) < 2 || !(to > from) {
+		return math.NaN()
+	}
+
+	sum, prev := float64(0), float64(0)
+	for ix, b := range h.Buckets {
+		start, end := prev, b.Count
+		prev = b.Count
+
+		// The part of this bucket's ranks that is kept.
+		lo, hi := math.Max(start, from), math.Min(end, to)
+		if hi <= lo {
+			continue
+		}
+
+		var lower, upper float64
+		switch {
+		case ix == len(h.Buckets)-1:
+			lower, upper = h.Buckets[ix-1].UpperBound, h.Buckets[ix-1].UpperBound
+		case ix == 0:
+			lower, upper = math.Min(0, b.UpperBound), b.UpperBound
+		default:
+			lower, upper = h.Buckets[ix-1].UpperBound, b.UpperBound
+		}
+
+		mid := (lo + hi) / 2
+		sum += (lower + (upper-lower)*(mid-start)/(end-start)) * (hi - lo)
+	}
+	return sum / (to - from)
+}
+
+// Overflow returns the number of samples above the largest finite bound, that
+// is in the +Inf bucket. Without finite bounds, there is nothing to overflow,
+// and it returns 0.
+func (h *Histogram) Overflow() float64 {
+	if len(h.Buckets) < 2 {
+		return 0
+	}
+	return h.Count - h.Buckets[len(h.Buckets)-2].Count
+}
+
+// Variance returns the population variance of the samples.
+func (h *Histogram) Variance() float64 {
+	return h.m2 / h.Count
+}
+
+// Stddev returns the population standard deviation of the samples.
+func (h *Histogram) Stddev() float64 {
+	return math.Sqrt(h.Variance())
+}
@@ -0,0 +1,68 @@
+package histogram
+
+import (
+	"math"
+	"testing"
+)
+
+func TestObserveOnBoundary(t *testing.T) {
+	for _, tc := range []struct {
+		lessThan bool
+		want     []float64 // cumulative counts
+	}{
+		{lessThan: false, want: []float64{0, 1, 1, 1}},
+		{lessThan: true, want: []float64{0, 0, 1, 1}},
+	} {
+		h := New([]float64{1, 2, 3})
+		h.LessThan = tc.lessThan
+		h.Observe(2, 1)
+
+		for ix, b := range h.Buckets {
+			if b.Count != tc.want[ix] {
+				t.Errorf("lessThan=%v: bucket %g has count %g, want %g", tc.lessThan, b.UpperBound, b.Count, tc.want[ix])
+			}
+		}
+	}
+}
+
+func TestStddev(t *testing.T) {
+	h := New([]float64{5})
+	for v := 1; v <= 10; v++ {
+		h.Observe(float64(v), 1)
+	}
+	if got, want := h.Variance(), 8.25; math.Abs(got-want) > 1e-12 {
+		t.Errorf("variance is %v, want %v", got, want)
+	}
+	if got, want := h.Stddev(), math.Sqrt(8.25); math.Abs(got-want) > 1e-12 {
+		t.Errorf("stddev is %v, want %v", got, want)
+	}
+}
+
+func TestGeoMean(t *testing.T) {
+	h := New([]float64{5})
+	for _, v := range []float64{1, 10, 100} {
+		h.Observe(v, 1)
+	}
+	if got := h.GeoMean(); math.Abs(got-10) > 1e-12 {
+		t.Errorf("geometric mean is %v, want 10", got)
+	}
+}
+
+func TestQuantileLeavesBucketsAlone(t *testing.T) {
+	h := New([]float64{1, 1, 2})
+	for _, v := range []float64{0.5, 1.5, 3} {
+		h.Observe(v, 1)
+	}
+	h.Quantile(0.5)
+	h.Observe(1.5, 1)
+
+	want := []float64{1, 1, 2, math.Inf(1)}
+	for ix, b := range h.Buckets {
+		if b.UpperBound != want[ix] {
+			t.Errorf("bucket %d has upper bound %g, want %g", ix, b.UpperBound, want[ix])
+		}
+	}
+	if got := h.Buckets[len(h.Buckets)-1].Count; got != 4 {
+		t.Errorf("+Inf bucket has count %g, want 4", got)
+	}
+}
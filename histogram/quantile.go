@@ -11,7 +11,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package histogram
 
 import (
 	"math"
@@ -20,21 +20,27 @@ import (
 
 // Helpers to calculate quantiles.
 
-type promBucket struct {
-	upperBound float64
-	count      float64
+// Bucket is a histogram bucket with a cumulative count, as in Prometheus.
+type Bucket struct {
+	UpperBound float64
+	Count      float64
+
+	// Min, max and sum of the samples that fell into this bucket only. Unlike
+	// Count, these are not cumulative.
+	Min, Max, Sum float64
 }
 
 // buckets implements sort.Interface.
-type buckets []promBucket
+type buckets []Bucket
 
 func (b buckets) Len() int           { return len(b) }
 func (b buckets) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
-func (b buckets) Less(i, j int) bool { return b[i].upperBound < b[j].upperBound }
+func (b buckets) Less(i, j int) bool { return b[i].UpperBound < b[j].UpperBound }
 
-// bucketQuantile calculates the quantile 'q' based on the given buckets. The
+// BucketQuantile calculates the quantile 'q' based on the given buckets. The
 // buckets will be sorted by upperBound by this function (i.e. no sorting
-// needed before calling this function). The quantile value is interpolated
+// needed before calling this function), and merged and adjusted in place, so
+// pass a copy of buckets that are still in use. The quantile value is interpolated
 // assuming a linear distribution within a bucket. However, if the quantile
 // falls into the highest bucket, the upper bound of the 2nd highest bucket is
 // returned. A natural lower bound of 0 is assumed if the upper bound of the
@@ -56,7 +62,17 @@ func (b buckets) Less(i, j int) bool { return b[i].upperBound < b[j].upperBound
 // If q<0, -Inf is returned.
 //
 // If q>1, +Inf is returned.
-func bucketQuantile(q float64, buckets buckets) float64 {
+//
+// Instead of interpolating, method can pick a fixed point of the bucket the
+// quantile falls into, similar to the methods of ExactQuantile:
+//
+//	linear, interpolate: interpolate linearly, as above
+//	lower:               the bucket's lower bound
+//	higher:              the bucket's upper bound
+//	nearest:             whichever bound the interpolated value is nearer to,
+//	                     the lower one if it is right in the middle
+//	midpoint:            the middle of the bucket
+func BucketQuantile(q float64, buckets buckets, method string) float64 {
 	if q < 0 {
 		return math.Inf(-1)
 	}
@@ -64,7 +80,7 @@ func bucketQuantile(q float64, buckets buckets) float64 {
 		return math.Inf(+1)
 	}
 	sort.Sort(buckets)
-	if !math.IsInf(buckets[len(buckets)-1].upperBound, +1) {
+	if !math.IsInf(buckets[len(buckets)-1].UpperBound, +1) {
 		return math.NaN()
 	}
 
@@ -74,30 +90,45 @@ func bucketQuantile(q float64, buckets buckets) float64 {
 	if len(buckets) < 2 {
 		return math.NaN()
 	}
-	observations := buckets[len(buckets)-1].count
+	observations := buckets[len(buckets)-1].Count
 	if observations == 0 {
 		return math.NaN()
 	}
 	rank := q * observations
-	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].Count >= rank })
 
 	if b == len(buckets)-1 {
-		return buckets[len(buckets)-2].upperBound
+		return buckets[len(buckets)-2].UpperBound
 	}
-	if b == 0 && buckets[0].upperBound <= 0 {
-		return buckets[0].upperBound
+	if b == 0 && buckets[0].UpperBound <= 0 {
+		return buckets[0].UpperBound
 	}
 	var (
 		bucketStart float64
-		bucketEnd   = buckets[b].upperBound
-		count       = buckets[b].count
+		bucketEnd   = buckets[b].UpperBound
+		count       = buckets[b].Count
 	)
 	if b > 0 {
-		bucketStart = buckets[b-1].upperBound
-		count -= buckets[b-1].count
-		rank -= buckets[b-1].count
+		bucketStart = buckets[b-1].UpperBound
+		count -= buckets[b-1].Count
+		rank -= buckets[b-1].Count
+	}
+
+	switch method {
+	case "lower":
+		return bucketStart
+	case "higher":
+		return bucketEnd
+	case "nearest":
+		if rank/count <= 0.5 {
+			return bucketStart
+		}
+		return bucketEnd
+	case "midpoint":
+		return (bucketStart + bucketEnd) / 2
+	default:
+		return bucketStart + (bucketEnd-bucketStart)*(rank/count)
 	}
-	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
 }
 
 // coalesceBuckets merges buckets with the same upper bound.
@@ -107,8 +138,8 @@ func coalesceBuckets(buckets buckets) buckets {
 	last := buckets[0]
 	i := 0
 	for _, b := range buckets[1:] {
-		if b.upperBound == last.upperBound {
-			last.count += b.count
+		if b.UpperBound == last.UpperBound {
+			last.Count += b.Count
 		} else {
 			buckets[i] = last
 			last = b
@@ -144,22 +175,22 @@ func coalesceBuckets(buckets buckets) buckets {
 // diverge such that small differences from missing samples are not a problem.
 // rate() removes this divergence.)
 //
-// bucketQuantile depends on that monotonicity to do a binary search for the
+// BucketQuantile depends on that monotonicity to do a binary search for the
 // bucket with the φ-quantile count, so breaking the monotonicity
-// guarantee causes bucketQuantile() to return undefined (nonsense) results.
+// guarantee causes BucketQuantile() to return undefined (nonsense) results.
 //
 // As a somewhat hacky solution until ingestion is atomic per scrape, we
 // calculate the "envelope" of the histogram buckets, essentially removing
 // any decreases in the count between successive buckets.
 
 func ensureMonotonic(buckets buckets) {
-	max := buckets[0].count
+	max := buckets[0].Count
 	for i := 1; i < len(buckets); i++ {
 		switch {
-		case buckets[i].count > max:
-			max = buckets[i].count
-		case buckets[i].count < max:
-			buckets[i].count = max
+		case buckets[i].Count > max:
+			max = buckets[i].Count
+		case buckets[i].Count < max:
+			buckets[i].Count = max
 		}
 	}
 }
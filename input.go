@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pstibrany/promfreq/histogram"
+)
+
+// input is a named source of input lines.
+type input struct {
+	name string
+	r    io.Reader
+	file *os.File // opened file to close, if any
+}
+
+// openInputs opens the files at paths, to be read in order. Without any paths,
+// or for a path of "-", stdin is read. Files ending in .gz, and stdin if
+// gzipStdin is set, are decompressed.
+func openInputs(paths []string, stdin io.Reader, gzipStdin bool) ([]input, error) {
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+
+	var inputs []input
+	for _, p := range paths {
+		in := input{name: p, r: stdin}
+		if p == "-" {
+			in.name = "stdin"
+		} else {
+			f, err := os.Open(p)
+			if err != nil {
+				closeInputs(inputs)
+				return nil, fmt.Errorf("cannot read input file %s: %v", p, err)
+			}
+			in.r, in.file = f, f
+		}
+
+		if p == "-" && gzipStdin || strings.HasSuffix(p, ".gz") {
+			gz, err := gzip.NewReader(in.r)
+			if err != nil {
+				closeInputs(append(inputs, in))
+				return nil, fmt.Errorf("cannot decompress input %s: %v", in.name, err)
+			}
+			in.r = gzipReader{gz}
+		}
+		inputs = append(inputs, in)
+	}
+	return inputs, nil
+}
+
+// gzipReader describes decompression errors, which are cryptic on their own,
+// such as a bare "unexpected EOF" for a truncated file.
+type gzipReader struct {
+	*gzip.Reader
+}
+
+func (r gzipReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("corrupt gzip stream: %v", err)
+	}
+	return n, err
+}
+
+// closeInputs closes the files opened by openInputs.
+func closeInputs(inputs []input) {
+	for _, in := range inputs {
+		if in.file != nil {
+			in.file.Close()
+		}
+	}
+}
+
+// readOptions controls how parseValues consumes input lines.
+type readOptions struct {
+	every   int  // if greater than 1, only every Nth line is used
+	limit   int  // if positive, reading stops after this many samples
+	lenient bool // skip lines that fail to parse instead of exiting
+	sorted  bool // fail if samples are not in ascending order
+
+	// If sampleRate is less than 1, lines are kept at random with this
+	// probability, drawn from rng.
+	sampleRate float64
+	rng        *rand.Rand
+
+	// Blank lines and lines starting with comment, if set, are skipped.
+	comment string
+
+	// If autoWeight is set and the first line looks like a "value weight" pair,
+	// all lines are parsed as such pairs. Later lines without a weight are
+	// counted once.
+	autoWeight bool
+
+	// progress, if set, is called after every observed sample.
+	progress func()
+
+	notes io.Writer // receives notes about the input, stderr usually
+}
+
+// readStats counts the lines seen by parseValues.
+type readStats struct {
+	read     int // all lines, except blank and comment lines
+	kept     int // lines left after -every and -sample-rate sampling
+	skipped  int // lines that failed to parse in lenient mode
+	observed int // samples passed on to the observer
+
+	limited bool // reading stopped at the limit, before the end of input
+}
+
+// observer receives the samples read by parseValues.
+type observer interface {
+	Observe(sample, weight float64)
+}
+
+// valueTally counts how many times each distinct value occurs.
+type valueTally map[float64]float64
+
+func (t valueTally) Observe(sample, weight float64) {
+	t[sample] += weight
+}
+
+// observeFrequencies adds the number of occurrences of each distinct value to
+// the histogram, in order of the values.
+func (t valueTally) observeFrequencies(h *histogram.Histogram) {
+	values := make([]float64, 0, len(t))
+	for v := range t {
+		values = append(values, v)
+	}
+	sort.Float64s(values)
+
+	for _, v := range values {
+		h.Observe(t[v], 1)
+	}
+}
+
+// sampleBuffer keeps all samples, for bucketing modes that need to see the
+// whole input before the buckets can be chosen.
+type sampleBuffer []histogram.WeightedSample
+
+func (b *sampleBuffer) Observe(sample, weight float64) {
+	if weight > 0 {
+		*b = append(*b, histogram.WeightedSample{Value: sample, Weight: weight})
+	}
+}
+
+// cappedBuffer is a sampleBuffer that holds at most max samples, unless max is
+// 0. Once full, it passes the buffered samples to full and observes all later
+// samples into next, so that memory stays bounded.
+type cappedBuffer struct {
+	samples sampleBuffer
+	max     int
+	full    func(sampleBuffer) error
+	next    observer
+
+	flushed bool
+	err     error // returned by full
+}
+
+func (b *cappedBuffer) Observe(sample, weight float64) {
+	if b.flushed {
+		b.next.Observe(sample, weight)
+		return
+	}
+
+	b.samples.Observe(sample, weight)
+	if b.max > 0 && len(b.samples) >= b.max {
+		b.flushed = true
+		b.err = b.full(b.samples)
+		b.samples = nil
+	}
+}
+
+// parseValues reads samples from the inputs, in order, into the observer. It
+// stops at the first line that cannot be parsed, unless opts.lenient is set.
+func parseValues(inputs []input, parser *lineParser, opts readOptions, obs observer) (rs readStats, err error) {
+	var last float64
+	var autoWeighted, unweightedNoted bool
+	for _, in := range inputs {
+		scanner := bufio.NewScanner(in.r)
+		scanner.Split(histogram.ScanLines)
+		for lineNo := 1; scanner.Scan(); lineNo++ {
+			line := scanner.Text()
+			if trimmed := strings.TrimSpace(line); trimmed == "" || opts.comment != "" && strings.HasPrefix(trimmed, opts.comment) {
+				continue
+			}
+			if opts.limit > 0 && rs.observed >= opts.limit {
+				rs.limited = true
+				return rs, nil
+			}
+
+			rs.read++
+			if opts.every > 1 && (rs.read-1)%opts.every != 0 {
+				continue
+			}
+			if opts.sampleRate < 1 && opts.rng.Float64() >= opts.sampleRate {
+				continue
+			}
+			rs.kept++
+
+			if opts.autoWeight && rs.kept == 1 && looksWeighted(line) {
+				parser.weighted = true
+				autoWeighted = true
+				fmt.Fprintln(opts.notes, "Input has two numeric columns, using the second one as weight. Use -no-auto-weight to disable.")
+			}
+
+			parse := parser.parse
+			unweighted := autoWeighted && !looksWeighted(line)
+			if unweighted {
+				parse = parser.parseUnweighted
+			}
+
+			sample, weight, ok, err := parse(line)
+			if err != nil {
+				if opts.lenient {
+					rs.skipped++
+					continue
+				}
+				return rs, fail(exitInput, fmt.Sprintf("line %d of %s: %v", lineNo, in.name, err))
+			}
+			if !ok {
+				continue
+			}
+			if unweighted && !unweightedNoted {
+				unweightedNoted = true
+				fmt.Fprintf(opts.notes, "Line %d of %s has no weight, counting lines without one once.\n", lineNo, in.name)
+			}
+
+			if opts.sorted {
+				if rs.observed > 0 && sample < last {
+					return rs, fail(exitInput, fmt.Sprintf("line %d of %s: input is not sorted: %g follows %g", lineNo, in.name, sample, last))
+				}
+				last = sample
+			}
+			rs.observed++
+
+			obs.Observe(sample, weight)
+			if opts.progress != nil {
+				opts.progress()
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return rs, fail(exitInput, fmt.Sprintf("Failed to read %s: %v", in.name, err))
+		}
+	}
+
+	return rs, nil
+}
+
+var (
+	expositionLineRegexp = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(?:\{(.*)\})?\s+(\S+)(?:\s+-?\d+)?$`)
+	leLabelRegexp        = regexp.MustCompile(`(?:^|,)\s*le\s*=\s*"([^"]*)"`)
+)
+
+// readPrometheusHistogram reads a histogram in the Prometheus text exposition
+// format, that is its name_bucket{le="..."}, name_sum and name_count series.
+// The cumulative bucket counts are taken as they are, without re-bucketing.
+// Series of the same histogram with different labels are added up, the way
+// sum by (le) would. Comments and series of other metrics are ignored.
+//
+// Only the buckets, sum and count are known, so min, max and the variance of
+// the returned histogram are NaN. Inconsistencies that still allow reading the
+// histogram are reported to stderr, unless strict is set, which makes them
+// errors.
+func readPrometheusHistogram(inputs []input, strict bool, stderr io.Writer) (*histogram.Histogram, error) {
+	var name string
+	counts := map[float64]float64{}
+	sum, total := math.NaN(), math.NaN()
+
+	for _, in := range inputs {
+		scanner := bufio.NewScanner(in.r)
+		scanner.Split(histogram.ScanLines)
+		for lineNo := 1; scanner.Scan(); lineNo++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			m := expositionLineRegexp.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("line %d of %s: invalid line in exposition format: %q", lineNo, in.name, line)
+			}
+			series, labels := m[1], m[2]
+
+			var base, suffix string
+			for _, s := range []string{"_bucket", "_sum", "_count"} {
+				if strings.HasSuffix(series, s) {
+					base, suffix = strings.TrimSuffix(series, s), s
+				}
+			}
+			if suffix == "" || (suffix == "_bucket" && !leLabelRegexp.MatchString(labels)) {
+				continue
+			}
+			if name == "" {
+				name = base
+			} else if base != name {
+				continue
+			}
+
+			v, err := strconv.ParseFloat(m[3], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d of %s: invalid value in line %q", lineNo, in.name, line)
+			}
+
+			switch suffix {
+			case "_bucket":
+				le, err := strconv.ParseFloat(leLabelRegexp.FindStringSubmatch(labels)[1], 64)
+				if err != nil || math.IsNaN(le) {
+					return nil, fmt.Errorf("line %d of %s: invalid le label in line %q", lineNo, in.name, line)
+				}
+				counts[le] += v
+			case "_sum":
+				sum = nanToZero(sum) + v
+			case "_count":
+				total = nanToZero(total) + v
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", in.name, err)
+		}
+	}
+
+	if len(counts) == 0 {
+		return nil, fmt.Errorf("no histogram buckets found in input")
+	}
+	if _, ok := counts[math.Inf(1)]; !ok {
+		return nil, fmt.Errorf("histogram %s has no le=\"+Inf\" bucket", name)
+	}
+
+	var bounds []float64
+	for le := range counts {
+		if !math.IsInf(le, 1) {
+			bounds = append(bounds, le)
+		}
+	}
+	sort.Float64s(bounds)
+
+	cumulative := make([]float64, 0, len(bounds)+1)
+	for _, le := range bounds {
+		cumulative = append(cumulative, counts[le])
+	}
+	cumulative = append(cumulative, counts[math.Inf(1)])
+
+	h, err := histogram.FromCumulative(bounds, cumulative, sum)
+	if err != nil {
+		return nil, fmt.Errorf("histogram %s: %v", name, err)
+	}
+	if !math.IsNaN(total) && total != h.Count {
+		if strict {
+			return nil, fmt.Errorf("histogram %s: %s_count is %g, but the +Inf bucket holds %g samples", name, name, total, h.Count)
+		}
+		fmt.Fprintf(stderr, "Warning: %s_count is %g, but the +Inf bucket holds %g samples.\n", name, total, h.Count)
+	}
+	return h, nil
+}
+
+// readPrometheusDelta reads two snapshots of a histogram in the Prometheus text
+// exposition format, such as two scrapes of the same target, and returns the
+// histogram of the samples observed in between.
+func readPrometheusDelta(before, after input, strict bool, stderr io.Writer) (*histogram.Histogram, error) {
+	first, err := readPrometheusHistogram([]input{before}, strict, stderr)
+	if err != nil {
+		return nil, err
+	}
+	second, err := readPrometheusHistogram([]input{after}, strict, stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(first.Buckets) != len(second.Buckets) {
+		return nil, fmt.Errorf("%s and %s have different buckets", before.name, after.name)
+	}
+	counts := make([]float64, len(second.Buckets))
+	for ix, b := range second.Buckets {
+		prev := first.Buckets[ix]
+		if prev.UpperBound != b.UpperBound {
+			return nil, fmt.Errorf("%s and %s have different buckets", before.name, after.name)
+		}
+		if b.Count < prev.Count {
+			return nil, fmt.Errorf("bucket le=%g decreased from %g in %s to %g in %s, was the counter reset?", b.UpperBound, prev.Count, before.name, b.Count, after.name)
+		}
+		counts[ix] = b.Count - prev.Count
+	}
+	return histogram.FromCumulative(second.Bounds, counts, second.Sum-first.Sum)
+}
+
+func nanToZero(v float64) float64 {
+	if math.IsNaN(v) {
+		return 0
+	}
+	return v
+}
+
+// inputs opens the files given as arguments, stdin without any, or the
+// built-in dataset with -demo.
+func (c *config) inputs(stdin io.Reader) ([]input, error) {
+	if c.demo {
+		return []input{{name: "demo", r: demoInput()}}, nil
+	}
+
+	inputs, err := openInputs(c.fs.Args(), stdin, c.gzipStdin)
+	if err != nil {
+		return nil, fail(exitInput, err)
+	}
+	// Only an uncompressed file can be followed, stdin is followed anyway.
+	if last := &inputs[len(inputs)-1]; c.follow && last.r == io.Reader(last.file) {
+		last.r = followReader{last.file}
+	}
+	return inputs, nil
+}
+
+// newParser returns the parser of input lines the flags ask for.
+func (c *config) newParser() *lineParser {
+	parser := &lineParser{delimiter: c.delimiter, field: c.field, colonValue: c.colonValue, weighted: c.weighted, positiveOnly: c.logBins, number: c.number, filter: c.filter}
+	if c.thousandsSep != "" || c.decimalSep != "." {
+		// Only input values, -buckets are always separated by commas.
+		parser.number = separatorParser(c.number, c.thousandsSep, c.decimalSep)
+	}
+	return parser
+}
+
+// newHistogram returns an empty histogram with the bounds, which keeps the
+// samples and statistics the flags ask for.
+func (c *config) newHistogram(bounds []float64) *histogram.Histogram {
+	h := histogram.New(bounds)
+	h.Exact = c.exact
+	h.QuantileMethod = c.quantileMethod
+	h.MaxBuffered = c.maxBuffered
+	h.Presorted = c.sortedInput
+	h.LessThan = c.bucketBound == "lt"
+	if isFlagSet(c.fs, "slow-threshold") {
+		h.TrackSlow = true
+		h.SlowThreshold = c.slowThreshold
+	}
+	return h
+}
+
+// readOptions returns the options parser reads the input with, except for
+// progress.
+func (c *config) readOptions(parser *lineParser, stderr io.Writer) readOptions {
+	seed := time.Now().UnixNano()
+	if isFlagSet(c.fs, "seed") {
+		seed = c.seed
+	}
+	return readOptions{
+		every:      c.every,
+		limit:      c.limit,
+		sampleRate: c.sampleRate,
+		rng:        rand.New(rand.NewSource(seed)),
+		lenient:    c.lenient,
+		sorted:     c.sortedInput,
+		comment:    c.comment,
+		notes:      stderr,
+		autoWeight: !c.noAutoWeight && !c.weighted && c.field == 0 && parser.filter == nil && !c.colonValue && c.delimiter == "",
+	}
+}
+
+// progress returns the function called after every sample, which writes
+// checkpoints and redraws the histogram with -flush-every, or nil if there
+// is nothing to do.
+func (c *config) progress(r *renderer, stderr io.Writer) func() {
+	flush := c.flushEvery > 0 && r.screen != nil
+	if c.checkpointPath == "" && !flush {
+		return nil
+	}
+
+	samples := 0
+	return func() {
+		samples++
+		if c.checkpointPath != "" && samples%c.checkpointEvery == 0 {
+			writeCheckpoint(c.checkpointPath, r.h, stderr)
+		}
+		if flush && samples%c.flushEvery == 0 {
+			r.draw()
+		}
+	}
+}
+
+// read reads the inputs into the renderer's histogram, and the -compare file
+// into its other one. In the auto modes, it also returns the samples if they
+// all fit into -max-buffered.
+func (c *config) read(inputs []input, stdin io.Reader, r *renderer, stderr io.Writer) (rs readStats, buf sampleBuffer, err error) {
+	parser := c.newParser()
+	ropts := c.readOptions(parser, stderr)
+	h := r.h
+
+	if c.resume {
+		if err := histogram.LoadCheckpoint(c.checkpointPath, h); err != nil {
+			return rs, nil, fail(exitInput, "Failed to resume:", err)
+		}
+	}
+	ropts.progress = c.progress(r, stderr)
+
+	if c.inputFormat == "prometheus" {
+		if c.delta {
+			h, err = readPrometheusDelta(inputs[0], inputs[1], c.strictInput, stderr)
+		} else {
+			h, err = readPrometheusHistogram(inputs, c.strictInput, stderr)
+		}
+		if err != nil {
+			return rs, nil, fail(exitInput, "Failed to read histogram:", err)
+		}
+		h.QuantileMethod = c.quantileMethod
+		r.h = h
+	} else if c.autoMode() {
+		choose := func(samples sampleBuffer) error {
+			return c.chooseBounds(h, samples, stderr)
+		}
+		bufOpts := ropts
+		bufOpts.progress = nil
+		capped := &cappedBuffer{max: c.maxBuffered, full: choose, next: h}
+		if rs, err = parseValues(inputs, parser, bufOpts, capped); err != nil {
+			return rs, nil, err
+		}
+		if capped.err != nil {
+			return rs, nil, capped.err
+		}
+
+		if capped.flushed {
+			fmt.Fprintf(stderr, "Buffered the maximum of %d samples, buckets were chosen from the first %d samples.\n", c.maxBuffered, c.maxBuffered)
+		} else {
+			buf = capped.samples
+			if err := choose(buf); err != nil {
+				return rs, nil, err
+			}
+		}
+	} else if c.valueFrequency {
+		tally := valueTally{}
+		if rs, err = parseValues(inputs, parser, ropts, tally); err != nil {
+			return rs, nil, err
+		}
+		tally.observeFrequencies(h)
+	} else if c.follow {
+		drawn := float64(0) // samples in the last snapshot
+		snapshot := func() {
+			if h.Count == drawn {
+				return
+			}
+			drawn = h.Count
+			r.draw()
+			if !isTerminal(r.out) {
+				fmt.Fprintln(r.out)
+			}
+		}
+		if rs, err = readFollowing(inputs, parser, ropts, h, c.interval, snapshot); err != nil {
+			return rs, nil, err
+		}
+	} else {
+		if rs, err = parseValues(inputs, parser, ropts, h); err != nil {
+			return rs, nil, err
+		}
+	}
+	if c.checkpointPath != "" {
+		writeCheckpoint(c.checkpointPath, h, stderr)
+	}
+
+	if c.compareFile != "" {
+		if r.other, err = c.readCompare(stdin, parser, ropts, h.Bounds, stderr); err != nil {
+			return rs, nil, err
+		}
+	}
+	return rs, buf, nil
+}
+
+// readCompare reads the -compare file into a histogram with the primary
+// input's buckets, which the auto modes have only chosen by now. An empty
+// file, like an empty input, has no statistics to show, and gives nil.
+func (c *config) readCompare(stdin io.Reader, parser *lineParser, ropts readOptions, bounds []float64, stderr io.Writer) (*histogram.Histogram, error) {
+	inputs, err := openInputs([]string{c.compareFile}, stdin, false)
+	if err != nil {
+		return nil, fail(exitInput, err)
+	}
+	defer closeInputs(inputs)
+
+	other := c.newHistogram(bounds)
+	ropts.progress = nil
+	ropts.autoWeight = ropts.autoWeight && !parser.weighted
+	if _, err := parseValues(inputs, parser, ropts, other); err != nil {
+		return nil, err
+	}
+	if other.Count == 0 {
+		fmt.Fprintf(stderr, "No samples read from %s, showing the input alone.\n", c.compareFile)
+		return nil, nil
+	}
+	return other, nil
+}
+
+// report notes how the input was sampled, limited or skipped.
+func (c *config) report(rs readStats, h *histogram.Histogram, stderr io.Writer) {
+	if c.every > 1 {
+		fmt.Fprintf(stderr, "Sampled one of every %d lines: kept %d of %d lines.\n", c.every, rs.kept, rs.read)
+	}
+	if c.sampleRate < 1 {
+		fmt.Fprintf(stderr, "Sampled lines at random with a rate of %g: kept %d of %d lines.\n", c.sampleRate, rs.kept, rs.read)
+	}
+	if rs.limited {
+		fmt.Fprintf(stderr, "Stopped at the limit of %d samples, after reading %d lines.\n", c.limit, rs.read)
+	}
+
+	if h.Capped {
+		// The rank of a quantile of a random sample of n is typically off by
+		// about 1/sqrt(n), which makes quantiles closer than that to 0 or 1
+		// mostly noise.
+		rankError := 1 / math.Sqrt(float64(h.MaxBuffered))
+		fmt.Fprintf(stderr, "Buffered the maximum of %d samples, quantiles are approximate: estimated from a random sample of the %d samples read, with a rank error of about %.2g %%.\n", h.MaxBuffered, h.Seen, 100*rankError)
+		for _, q := range c.quantiles {
+			if math.Min(q, 1-q) < rankError {
+				fmt.Fprintf(stderr, "Warning: %s is within the rank error of the extremes, increase -max-buffered to estimate it.\n", quantileName(q))
+			}
+		}
+	}
+	if rs.skipped > 0 {
+		fmt.Fprintf(stderr, "Skipped %d lines that could not be parsed.\n", rs.skipped)
+	}
+}
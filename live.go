@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/pstibrany/promfreq/histogram"
+)
+
+// liveScreen redraws output in place on a terminal, by moving the cursor back
+// up over the previously drawn lines and clearing them.
+type liveScreen struct {
+	out   io.Writer
+	lines int // number of lines drawn last time
+}
+
+func (s *liveScreen) draw(render func(io.Writer)) {
+	var buf bytes.Buffer
+	render(&buf)
+
+	if s.lines > 0 {
+		fmt.Fprintf(s.out, "\x1b[%dA\x1b[J", s.lines)
+	}
+	s.out.Write(buf.Bytes())
+	s.lines = bytes.Count(buf.Bytes(), []byte("\n"))
+}
+
+// followPoll is how often followReader checks for more data at the end of
+// the file.
+const followPoll = 200 * time.Millisecond
+
+// followReader reads a file like tail -f: at the end of the file, it waits
+// for more data to be appended instead of returning io.EOF.
+type followReader struct {
+	r io.Reader
+}
+
+func (f followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		time.Sleep(followPoll)
+	}
+}
+
+// readFollowing reads the inputs into h like parseValues does, but in the
+// background, calling snapshot every interval until all input is read. Reading
+// and snapshot take turns on h, so snapshot can render it.
+func readFollowing(inputs []input, parser *lineParser, opts readOptions, h *histogram.Histogram, interval time.Duration, snapshot func()) (readStats, error) {
+	var mu sync.Mutex
+	if progress := opts.progress; progress != nil {
+		opts.progress = func() {
+			mu.Lock()
+			defer mu.Unlock()
+			progress()
+		}
+	}
+
+	var (
+		rs   readStats
+		err  error
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		rs, err = parseValues(inputs, parser, opts, lockedObserver{&mu, h})
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			mu.Lock()
+			snapshot()
+			mu.Unlock()
+		case <-done:
+			return rs, err
+		}
+	}
+}
+
+// lockedObserver holds the lock while observing a sample.
+type lockedObserver struct {
+	mu  *sync.Mutex
+	obs observer
+}
+
+func (o lockedObserver) Observe(sample, weight float64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.obs.Observe(sample, weight)
+}
+
+// isTerminal reports whether w is a terminal rather than a file, a pipe or
+// some other writer.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalWidth returns the width of the terminal w is connected to, or 0 if
+// w is not a terminal.
+func terminalWidth(w io.Writer) int {
+	if !isTerminal(w) {
+		return 0
+	}
+	width, _, err := term.GetSize(int(w.(*os.File).Fd()))
+	if err != nil {
+		return 0
+	}
+	return width
+}
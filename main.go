@@ -1,194 +1,638 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"io"
 	"math"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mattn/go-runewidth"
+
+	"github.com/pstibrany/promfreq/histogram"
 )
 
 func main() {
-	start := flag.Float64("start", 1, "Start value for linear or exponential buckets.")
-	factor := flag.Float64("factor", 5, "Factor used when computing exponential buckets.")
-	width := flag.Float64("width", 1, "Width of linear buckets")
-	count := flag.Int("count", 10, "Number of linear or exponential buckets")
-	mode := flag.String("mode", "linear", "Linear or exponential.")
-	columnWidth := flag.Int("column-width", 30, "Width of the largest bin")
-	explicitBounds := flag.String("buckets", "", "Explicit buckets: comma separated bucket boundaries.")
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
 
-	flag.Parse()
+// run runs promfreq with the command-line arguments args, not including the
+// program name, and returns the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	err := execute(args, stdin, stdout, stderr)
+	if err == nil {
+		return 0
+	}
 
-	scanner := bufio.NewScanner(os.Stdin)
+	code := exitError
+	if e, ok := err.(*exitCodeError); ok {
+		code = e.code
+	}
+	if msg := err.Error(); msg != "" {
+		fmt.Fprintln(stderr, msg)
+	}
+	return code
+}
 
-	var bounds []float64
-	var err error
+// execute reads the input named by args and writes the histogram.
+func execute(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	c, err := parseFlags(args, stderr)
+	if c == nil {
+		return err
+	}
+	if c.helpModes {
+		printModes(stdout)
+		return nil
+	}
+	if err := c.check(); err != nil {
+		return err
+	}
 
-	if *explicitBounds != "" {
-		bounds, err = parseBucketBoundaries(*explicitBounds)
-	} else if *mode == "linear" || *mode == "lin" {
-		bounds, err = linearBuckets(*start, *width, *count)
-	} else if *mode == "exponential" || *mode == "exp" {
-		bounds, err = exponentialBuckets(*start, *factor, *count)
+	bounds, err := c.bounds(stderr)
+	if err != nil {
+		return err
 	}
+	if c.printBuckets {
+		for _, b := range bounds {
+			fmt.Fprintln(stdout, c.format(b))
+		}
+		return nil
+	}
+
+	inputs, err := c.inputs(stdin)
+	if err != nil {
+		return err
+	}
+	defer closeInputs(inputs)
 
+	r := c.newRenderer(c.newHistogram(bounds), stdout)
+	rs, buf, err := c.read(inputs, stdin, r, stderr)
 	if err != nil {
-		printlnAndExit("Failed to create buckets:", err)
+		return err
+	}
+	h := r.h
+	c.report(rs, h, stderr)
+
+	// Without samples, there is nothing to show, and averages, percentages and
+	// quantiles would all be NaN.
+	if h.Count == 0 {
+		fmt.Fprintln(stderr, "No samples read.")
+		return nil
 	}
 
-	buckets, sum, samples, min, max := parseValues(scanner, bounds)
+	if c.validate {
+		r.check(buf, stderr)
+	}
 
-	printHistogram(os.Stdout, buckets, samples, float64(*columnWidth), true)
-	printSummary(os.Stdout, buckets, sum, samples, min, max)
-}
+	// Samples in the +Inf bucket are all shown at the largest boundary, which
+	// hides how far beyond it they go.
+	if overflow := h.Overflow() / h.Count; !c.noWarn && overflow > c.overflowThreshold {
+		largest := h.Buckets[len(h.Buckets)-2].UpperBound
+		fmt.Fprintf(stderr, "Warning: %0.1f %% of samples are above the largest bucket boundary %s, consider buckets covering a larger range.\n", 100*overflow, c.format(largest))
+	}
 
-func parseBucketBoundaries(inp string) ([]float64, error) {
-	s := strings.Split(inp, ",")
+	r.draw()
+	return r.err
+}
 
-	result := make([]float64, 0, len(s))
-	for _, b := range s {
-		v, err := strconv.ParseFloat(b, 64)
+// parseQuantiles parses a comma-separated list of quantiles, each of which
+// must be in (0, 1].
+func parseQuantiles(inp string) ([]float64, error) {
+	var result []float64
+	for _, s := range strings.Split(inp, ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
 		if err != nil {
-			return nil, fmt.Errorf("non-numeric input: %q", b)
+			return nil, fmt.Errorf("non-numeric quantile: %q", s)
 		}
-		result = append(result, v)
+		if !(q > 0 && q <= 1) {
+			return nil, fmt.Errorf("quantile must be in (0, 1], got: %g", q)
+		}
+		result = append(result, q)
 	}
-
-	sort.Float64s(result)
 	return result, nil
 }
 
-// Returns sum of values for each bucket, total sum and total number of samples. One extra bucket for values larger
-// than latest bucket is created. Input buckets must be sorted.
-func parseValues(scanner *bufio.Scanner, buckets []float64) (result []promBucket, sum, count, min, max float64) {
-	result = make([]promBucket, len(buckets)+1)
-	for ix := 0; ix < len(buckets); ix++ {
-		result[ix].upperBound = buckets[ix]
-	}
-	result[len(buckets)].upperBound = math.Inf(1)
-
-	first := true
+// quantileName names a quantile as a percentile, e.g. p99.9 for 0.999.
+func quantileName(q float64) string {
+	return fmt.Sprintf("p%g", histogram.TrimFloatNoise(q*100))
+}
 
-	for scanner.Scan() {
-		v := strings.TrimSpace(scanner.Text())
-		sample, err := strconv.ParseFloat(v, 64)
-		if err != nil {
-			printlnAndExit("found non-numerical input:", v)
+// hiddenFlags are left out of the usage message.
+var hiddenFlags = map[string]bool{"demo": true}
+
+// usage prints the defaults of all flags of fs except the hidden ones.
+func usage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [file ...]\n", fs.Name())
+
+	visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	visible.SetOutput(out)
+	fs.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+			// Var takes the current value as the default, which flags set
+			// before the usage is printed have changed.
+			visible.Lookup(f.Name).DefValue = f.DefValue
 		}
+	})
+	visible.PrintDefaults()
 
-		if first {
-			min = sample
-			max = sample
-			first = false
-		}
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Exit status:")
+	fmt.Fprintf(out, "  0  success, also when there are no samples\n")
+	fmt.Fprintf(out, "  %d  other failures, such as failing to write output\n", exitError)
+	fmt.Fprintf(out, "  %d  invalid flags or bucket configuration\n", exitUsage)
+	fmt.Fprintf(out, "  %d  input that cannot be read or parsed\n", exitInput)
+}
 
-		if sample < min {
-			min = sample
+// setFlagsFromEnv sets flags from PROMFREQ_<NAME> environment variables, e.g.
+// -column-width from PROMFREQ_COLUMN_WIDTH. It must be called before the
+// arguments are parsed, so that flags given on the command line take
+// precedence.
+func setFlagsFromEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := "PROMFREQ_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		v, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
 		}
-		if sample > max {
-			max = sample
+		if setErr := fs.Set(f.Name, v); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", v, name, setErr)
 		}
+	})
+	return err
+}
 
-		// Increment all buckets where sample is <= upperBound.
-		for ix := sort.SearchFloat64s(buckets, sample); ix < len(result); ix++ {
-			result[ix].count++
-		}
-		sum += sample
-		count++
+// writeCheckpoint saves the histogram to path. Failures are reported but not
+// fatal, so that a full disk doesn't abort a long aggregation.
+func writeCheckpoint(path string, h *histogram.Histogram, stderr io.Writer) {
+	if err := histogram.SaveCheckpoint(path, h); err != nil {
+		fmt.Fprintln(stderr, "Failed to write checkpoint:", err)
 	}
+}
+
+// isFlagSet reports whether the flag was given on the command line or through
+// its environment variable.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// Exit codes, besides 0 for success.
+const (
+	exitError = 1 // other failures, such as failing to write output
+	exitUsage = 2 // invalid flags or bucket configuration
+	exitInput = 3 // input that cannot be read or parsed
+)
+
+// exitCodeError is an error that makes run return the given exit code. An
+// empty message isn't printed.
+type exitCodeError struct {
+	code int
+	msg  string
+}
+
+func (e *exitCodeError) Error() string {
+	return e.msg
+}
+
+// fail returns an error with the exit code and a message formatted like
+// fmt.Println does, without the line feed.
+func fail(code int, a ...interface{}) error {
+	return &exitCodeError{code: code, msg: strings.TrimSuffix(fmt.Sprintln(a...), "\n")}
+}
 
-	return
+// histogramOptions controls how printHistogram renders the histogram.
+type histogramOptions struct {
+	barWidth    float64 // width of the widest bar
+	totalWidth  int     // if positive, width of the whole line; overrides barWidth
+	justify     bool    // right-justify labels
+	alignCounts bool    // right-justify count and percent columns
+	bucketStats bool    // show min, mean and max of the samples in each bucket
+	runningPct  bool    // show the cumulative percentage up to each bucket
+	cumulative  bool    // show cumulative counts instead of counts per bucket
+
+	// If normalizeTotal is set, bar lengths are the share of all samples,
+	// so that a bar of the full width holds all of them. Otherwise the
+	// fullest bucket has a bar of the full width.
+	normalizeTotal bool
+
+	lessThan bool // buckets hold samples below their upper bound, [a .. b)
+
+	format valueFormat
+
+	// highlightCumulative marks the first bucket at which the cumulative
+	// percentage of samples reaches this value. Zero disables the marker.
+	highlightCumulative float64
+
+	// If duration is positive, counts are shown as rates per second over
+	// that duration.
+	duration time.Duration
+
+	groupDigits bool   // separate thousands in counts with commas
+	ascii       bool   // draw with ASCII characters only
+	barChar     string // if set, bars repeat this character instead of boxes
+	hideEmpty   bool   // leave out buckets without samples
+	color       bool   // color bars by their length, with ANSI escapes
+	invert      bool   // vertical bars hang down from an axis at the top
+	logScale    bool   // vertical bar heights are logarithmic
 }
 
-func linearBuckets(start, width float64, count int) ([]float64, error) {
-	if count < 1 {
-		return nil, fmt.Errorf("--linear-buckets needs a positive count")
+// formatCount formats the number of samples in a bucket.
+func (opts histogramOptions) formatCount(count float64) string {
+	if opts.duration > 0 {
+		return fmt.Sprintf("%.4g/s", count/opts.duration.Seconds())
 	}
-	buckets := make([]float64, count)
-	for i := range buckets {
-		buckets[i] = start
-		start += width
+	if opts.groupDigits {
+		return groupThousands(fmt.Sprintf("%.0f", count))
 	}
-	return buckets, nil
+	return fmt.Sprintf("%.0f", count)
 }
 
-func exponentialBuckets(start, factor float64, count int) ([]float64, error) {
-	if count < 1 {
-		return nil, fmt.Errorf("exponential buckets need a positive count")
+// groupThousands inserts commas between groups of three digits of an integer,
+// e.g. 1234567 becomes 1,234,567.
+func groupThousands(digits string) string {
+	var b strings.Builder
+	for i, r := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// printHistogram displays a histogram. The bar width determines the width of
+// the widest bar. Labels can optionally be right justified.
+func printHistogram(out io.Writer, buckets []histogram.Bucket, samples float64, opts histogramOptions) {
+	allLabels := bucketLabels(buckets, opts)
+
+	var (
+		rows     []int // indices of the displayed buckets
+		labels   []string
+		counts   []string
+		percents []string
+		details  []string
+		widths   []float64
+	)
+
+	prev := float64(0)
+	for ix := range buckets {
+		bucketSamples := buckets[ix].Count - prev
+		prev = buckets[ix].Count
+
+		if opts.hideEmpty && bucketSamples == 0 {
+			continue
+		}
+		rows = append(rows, ix)
+		labels = append(labels, allLabels[ix])
+
+		shown := bucketSamples
+		if opts.cumulative {
+			shown = buckets[ix].Count
+		}
+
+		counts = append(counts, opts.formatCount(shown))
+		percents = append(percents, fmt.Sprintf("(%0.1f %%)", 100*shown/samples))
+		widths = append(widths, shown)
+
+		detail := ""
+		if opts.runningPct {
+			detail += fmt.Sprintf(" cum=%0.1f %%", 100*buckets[ix].Count/samples)
+		}
+		if opts.bucketStats && bucketSamples > 0 {
+			b := buckets[ix]
+			detail += fmt.Sprintf(" min=%s mean=%s max=%s", opts.format(b.Min), opts.format(b.Sum/bucketSamples), opts.format(b.Max))
+		}
+		details = append(details, detail)
 	}
-	if start <= 0 {
-		return nil, fmt.Errorf("exponential buckets need a positive start value")
+
+	maxFreq := maxFrequency(buckets)
+	if opts.cumulative || opts.normalizeTotal {
+		maxFreq = samples
 	}
-	if factor <= 1 {
-		return nil, fmt.Errorf("exponential buckets need a factor greater than 1")
+
+	var (
+		labelWidth   = maxStringWidth(labels)
+		countWidth   = maxStringWidth(counts)
+		percentWidth = maxStringWidth(percents)
+		detailWidth  = maxStringWidth(details)
+		highlighted  = highlightedBucket(buckets, samples, opts.highlightCumulative)
+		marker       = ""
+		barWidth     = opts.barWidth
+	)
+
+	if highlighted >= 0 {
+		arrow := "◀"
+		if opts.ascii {
+			arrow = "<"
+		}
+		marker = fmt.Sprintf(" %s %g%%", arrow, opts.highlightCumulative)
 	}
-	buckets := make([]float64, count)
-	for i := range buckets {
-		buckets[i] = start
-		start *= factor
+
+	if opts.totalWidth > 0 {
+		// Whatever remains after the label, count, percent and detail columns,
+		// the separating spaces, the marker and the bar's trailing partial glyph.
+		reserved := labelWidth + countWidth + percentWidth + detailWidth + runewidth.StringWidth(marker) + 4
+		barWidth = math.Max(float64(opts.totalWidth-reserved), 0)
+	}
+
+	for row, ix := range rows {
+		normalizedWidth := widths[row] / maxFreq
+
+		width := normalizedWidth * barWidth
+		prefix := paddedString(labels[row], labelWidth, opts.justify)
+		bar, count, percent, detail := column(width, opts.boxes()), counts[row], percents[row], details[row]
+
+		if opts.alignCounts {
+			bar = fill(bar, int(barWidth)+1)
+			count = just(count, countWidth)
+			percent = just(percent, percentWidth)
+		}
+		if opts.color {
+			bar = colorize(bar, normalizedWidth)
+		}
+
+		suffix := ""
+		if ix == highlighted {
+			suffix = marker
+		}
+
+		fmt.Fprintf(out, "%s %s %s %s%s%s\n", prefix, bar, count, percent, detail, suffix)
 	}
-	return buckets, nil
 }
 
-func printlnAndExit(a ...interface{}) {
-	fmt.Fprintln(os.Stderr, a...)
-	os.Exit(1)
+// printTitle prints the title on its own line, in bold if color is set.
+// Without a title, it prints nothing.
+func printTitle(out io.Writer, title string, color bool) {
+	if title == "" {
+		return
+	}
+	if color {
+		title = "\x1b[1m" + title + "\x1b[0m"
+	}
+	fmt.Fprintln(out, title)
 }
 
-// printHistogram displays a histogram. The bar width determines the width of
-// the widest bar. Labels can optionally be right justified.
-func printHistogram(out io.Writer, buckets []promBucket, samples float64, barWidth float64, justify bool) {
+// bucketLabels returns the range label of each bucket, with boundaries
+// formatted by format. Brackets show which bound is included: (a .. b] by
+// default, [a .. b) with lessThan.
+func bucketLabels(buckets []histogram.Bucket, opts histogramOptions) []string {
+	format, inf := opts.format, "∞"
+	if opts.ascii {
+		inf = "inf"
+	}
+	left, right := "(", "]"
+	if opts.lessThan {
+		left, right = "[", ")"
+	}
+
 	var labels []string
 	for i := 0; i < len(buckets); i++ {
 		switch {
 		case i == 0:
-			labels = append(labels, fmt.Sprintf("(-∞ .. %0.6g]", buckets[i].upperBound))
+			labels = append(labels, fmt.Sprintf("(-%s .. %s%s", inf, format(buckets[i].UpperBound), right))
 		case i == len(buckets)-1:
-			labels = append(labels, fmt.Sprintf("(%.6g .. +∞)", buckets[i-1].upperBound))
+			labels = append(labels, fmt.Sprintf("%s%s .. +%s)", left, format(buckets[i-1].UpperBound), inf))
 		default:
-			labels = append(labels, fmt.Sprintf("(%.6g .. %.6g]", buckets[i-1].upperBound, buckets[i].upperBound))
+			labels = append(labels, fmt.Sprintf("%s%s .. %s%s", left, format(buckets[i-1].UpperBound), format(buckets[i].UpperBound), right))
 		}
 	}
+	return labels
+}
 
-	var (
-		maxFreq    = maxFrequency(buckets)
-		labelWidth = maxStringWidth(labels)
-	)
+// highlightedBucket returns the index of the first bucket at which the
+// cumulative percentage of samples reaches threshold, or -1 if threshold is
+// not positive.
+func highlightedBucket(buckets []histogram.Bucket, samples, threshold float64) int {
+	if threshold <= 0 {
+		return -1
+	}
 
-	prev := float64(0)
 	for ix := range buckets {
-		bucketSamples := buckets[ix].count - prev
-		normalizedWidth := bucketSamples / maxFreq
-		prev = buckets[ix].count
+		if 100*buckets[ix].Count/samples >= threshold {
+			return ix
+		}
+	}
 
-		width := normalizedWidth * barWidth
-		prefix := paddedString(labels[ix], labelWidth, justify)
+	return -1
+}
+
+// summaryOptions controls what printSummary reports.
+type summaryOptions struct {
+	extended bool // include additional statistics
+	compact  bool // single line without the header, e.g. for shell prompts
+
+	duration time.Duration // if positive, also report the rate over this duration
+
+	quantiles []float64 // quantiles to report, e.g. 0.99 for p99
+	precision int       // significant digits of values, as many as needed if 0
+
+	// If set, format is used for values in the unit of the samples, such as
+	// quantiles, instead of plain numbers.
+	format valueFormat
+
+	// If trimmed is set, the mean without the lowest and highest trim
+	// fraction of samples is reported.
+	trimmed bool
+	trim    float64
+
+	heading string // printed above the statistics instead of "summary"
+	prefix  string // prepended to the name of each statistic in compact output
+
+	labels histogramOptions // formats the range of the modal bucket
 
-		fmt.Fprintf(out, "%s %s %.0f (%0.1f %%)\n", prefix, column(width), bucketSamples, 100*bucketSamples/samples)
+	// checks compare estimated quantiles with exact ones. Those off by more
+	// than the tolerance, relative to the exact value, are marked.
+	checks    []quantileCheck
+	tolerance float64
+}
+
+// formatSample formats a statistic in the unit of the samples.
+func (opts summaryOptions) formatSample(v float64) string {
+	if opts.format != nil {
+		return opts.format(v)
+	}
+	return opts.formatValue(v)
+}
+
+// formatValue formats a statistic for the summary.
+func (opts summaryOptions) formatValue(v float64) string {
+	if opts.precision > 0 {
+		return strconv.FormatFloat(v, 'g', opts.precision, 64)
 	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
 }
 
-func printSummary(out io.Writer, bucketVals []promBucket, sum, samples, min, max float64) {
+func printSummary(out io.Writer, h *histogram.Histogram, opts summaryOptions) {
 	stats := []string{
-		fmt.Sprintf("%s=%.0f", "count", samples),
-		fmt.Sprintf("%s=%g", "p50", bucketQuantile(0.5, bucketVals)),
-		fmt.Sprintf("%s=%g", "p90", bucketQuantile(0.9, bucketVals)),
-		fmt.Sprintf("%s=%g", "p95", bucketQuantile(0.95, bucketVals)),
-		fmt.Sprintf("%s=%g", "p99", bucketQuantile(0.99, bucketVals)),
-		fmt.Sprintf("%s=%g", "avg", sum/samples),
-		fmt.Sprintf("%s=%g", "min", min),
-		fmt.Sprintf("%s=%g", "max", max),
+		fmt.Sprintf("%s=%.0f", "count", h.Count),
+	}
+	// Statistics that aren't known are left out, such as the min and max of
+	// histograms read with -input prometheus.
+	add := func(name string, v float64, format func(float64) string) {
+		if !math.IsNaN(v) {
+			stats = append(stats, fmt.Sprintf("%s=%s", name, format(v)))
+		}
+	}
+	for _, q := range opts.quantiles {
+		add(quantileName(q), h.Quantile(q), opts.formatSample)
+	}
+	add("avg", h.Sum/h.Count, opts.formatSample)
+	if opts.trimmed {
+		add("tmean", h.TrimmedMean(opts.trim), opts.formatSample)
+	}
+	add("geomean", h.GeoMean(), opts.formatSample)
+	add("hmean", h.HarmonicMean(), opts.formatSample)
+	add("min", h.Min, opts.formatSample)
+	add("max", h.Max, opts.formatSample)
+	add("stddev", h.Stddev(), opts.formatSample)
+	add("variance", h.Variance(), opts.formatValue)
+
+	if modal := h.ModalBucket(); modal >= 0 {
+		label := bucketLabels(h.Buckets, opts.labels)[modal]
+		if opts.compact {
+			label = strings.Replace(label, " ", "", -1)
+		}
+		stats = append(stats, fmt.Sprintf("%s=%s", "mode", label))
+	}
+
+	if opts.duration > 0 {
+		stats = append(stats, fmt.Sprintf("%s=%s/s", "rate", opts.formatValue(h.Count/opts.duration.Seconds())))
+	}
+
+	if opts.extended {
+		add("cv", h.Stddev()/h.Mean(), opts.formatValue)
+	}
+
+	if opts.compact {
+		if h.TrackSlow {
+			stats = append(stats, fmt.Sprintf("above_%g=%.0f", h.SlowThreshold, h.Slow))
+		}
+		if h.NonPositive > 0 {
+			stats = append(stats, fmt.Sprintf("nonpositive=%.0f", h.NonPositive))
+		}
+		stats = append(stats, fmt.Sprintf("overflow=%.0f", h.Overflow()))
+		for _, c := range opts.checks {
+			name := quantileName(c.q)
+			stats = append(stats,
+				fmt.Sprintf("%s_estimated=%s", name, opts.formatSample(c.estimated)),
+				fmt.Sprintf("%s_exact=%s", name, opts.formatSample(c.exact)),
+				fmt.Sprintf("%s_error=%+0.1f%%%s", name, 100*c.error(), c.mark(opts.tolerance)),
+			)
+		}
+		for ix := range stats {
+			stats[ix] = opts.prefix + stats[ix]
+		}
+		fmt.Fprintln(out, strings.Join(stats, " "))
+		return
 	}
 
 	fmt.Fprintln(out)
-	fmt.Fprintln(out, "summary:")
+	heading := opts.heading
+	if heading == "" {
+		heading = "summary"
+	}
+	fmt.Fprintln(out, heading+":")
 	fmt.Fprintln(out, " "+strings.Join(stats, ", "))
+
+	if h.TrackSlow {
+		fmt.Fprintf(out, " above_%g: %.0f (%0.1f %%)\n", h.SlowThreshold, h.Slow, 100*h.Slow/h.Count)
+	}
+	overflow := " overflow"
+	if len(h.Buckets) > 1 {
+		overflow += " above " + opts.formatSample(h.Buckets[len(h.Buckets)-2].UpperBound)
+	}
+	fmt.Fprintf(out, "%s: %.0f (%0.1f %%)\n", overflow, h.Overflow(), 100*h.Overflow()/h.Count)
+	if h.NonPositive > 0 {
+		fmt.Fprintf(out, " non-positive, left out of geomean and hmean: %.0f\n", h.NonPositive)
+	}
+
+	if len(opts.checks) > 0 {
+		fmt.Fprintln(out)
+		fmt.Fprintf(out, "quantiles estimated from buckets vs. exact, tolerance %g %%:\n", 100*opts.tolerance)
+		for _, c := range opts.checks {
+			mark := c.mark(opts.tolerance)
+			if mark != "" {
+				mark = " " + mark
+			}
+			fmt.Fprintf(out, " %s: estimated=%s exact=%s error=%+0.1f %%%s\n", quantileName(c.q), opts.formatSample(c.estimated), opts.formatSample(c.exact), 100*c.error(), mark)
+		}
+	}
+}
+
+// quantileCheck is a quantile estimated from buckets along with its exact
+// value, computed from the samples.
+type quantileCheck struct {
+	q, estimated, exact float64
+}
+
+// error returns the error of the estimate, relative to the exact value.
+func (c quantileCheck) error() float64 {
+	return (c.estimated - c.exact) / math.Abs(c.exact)
+}
+
+// mark returns "!" if the estimate is off by more than the tolerance, and an
+// empty string otherwise.
+func (c quantileCheck) mark(tolerance float64) string {
+	if !(math.Abs(c.error()) <= tolerance) && c.estimated != c.exact {
+		return "!"
+	}
+	return ""
+}
+
+// checkQuantiles estimates the quantiles from the histogram's buckets and
+// computes them from its retained samples or, if it doesn't retain them, from
+// buf, the samples of the auto modes. Without samples, there is nothing to
+// check.
+func checkQuantiles(h *histogram.Histogram, buf sampleBuffer, quantiles []float64) []quantileCheck {
+	if !h.Exact && len(buf) == 0 {
+		return nil
+	}
+	histogram.SortSamples(buf)
+
+	var checks []quantileCheck
+	for _, q := range quantiles {
+		c := quantileCheck{q: q}
+		if h.Exact {
+			// BucketQuantile sorts and merges the buckets in place.
+			buckets := append([]histogram.Bucket(nil), h.Buckets...)
+			c.estimated, c.exact = histogram.BucketQuantile(q, buckets, h.QuantileMethod), h.Quantile(q)
+		} else {
+			c.estimated, c.exact = h.Quantile(q), histogram.ExactQuantile(q, buf, h.Count, h.QuantileMethod)
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// printPercentileTable prints the quantile function of the buckets, from step
+// percent up to, but excluding, 100 percent. Values are formatted like the
+// quantiles of the summary.
+func printPercentileTable(out io.Writer, h *histogram.Histogram, step float64, opts summaryOptions) {
+	var names, values []string
+	for i := 1; float64(i)*step < 100; i++ {
+		p := histogram.TrimFloatNoise(float64(i) * step)
+		names = append(names, fmt.Sprintf("p%g", p))
+		values = append(values, opts.formatSample(h.Quantile(p/100)))
+	}
+
+	nameWidth := maxStringWidth(names)
+
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "percentiles:")
+	for ix := range names {
+		fmt.Fprintf(out, " %s %s\n", just(names[ix], nameWidth), values[ix])
+	}
 }
 
 // paddedString returns the string justified in a string of given width.
@@ -208,14 +652,55 @@ func just(s string, w int) string {
 	return strings.Repeat(" ", w-runewidth.StringWidth(s)) + s
 }
 
-var boxes = []string{"▏", "▎", "▍", "▌", "▋", "▊", "▉", "█"}
+var (
+	boxes      = []string{"▏", "▎", "▍", "▌", "▋", "▊", "▉", "█"}
+	asciiBoxes = []string{".", ":", "=", "#"}
+)
+
+// boxes returns the glyphs bars are drawn with, from the smallest partial box
+// to the full one.
+func (opts histogramOptions) boxes() []string {
+	if opts.barChar != "" {
+		return []string{opts.barChar}
+	}
+	if opts.ascii {
+		return asciiBoxes
+	}
+	return boxes
+}
+
+// columns returns a horizontal bar of a given size, drawn with boxes. A
+// partial box is only appended if size has a fractional part. With a single
+// box, there are no partial ones, and the size is rounded to whole boxes of
+// the box's width instead.
+func column(size float64, boxes []string) string {
+	if len(boxes) == 1 {
+		return strings.Repeat(boxes[0], int(math.Round(size/float64(runewidth.StringWidth(boxes[0])))))
+	}
+
+	full := strings.Repeat(boxes[len(boxes)-1], int(size))
 
-// columns returns a horizontal bar of a given size.
-func column(size float64) string {
 	fraction := size - math.Floor(size)
+	if fraction == 0 {
+		return full
+	}
+
 	index := int(fraction * float64(len(boxes)))
+	return full + boxes[index]
+}
 
-	return strings.Repeat(boxes[len(boxes)-1], int(size)) + boxes[index]
+// colorize wraps a bar in ANSI escapes, coloring long bars red, medium ones
+// yellow and short ones green. Size is the bar's length relative to the
+// longest bar.
+func colorize(bar string, size float64) string {
+	color := "32" // green
+	switch {
+	case size > 2.0/3:
+		color = "31" // red
+	case size > 1.0/3:
+		color = "33" // yellow
+	}
+	return "\x1b[" + color + "m" + bar + "\x1b[0m"
 }
 
 // maxStringWidth returns the width of the widest string in a string slice. It
@@ -233,15 +718,14 @@ func maxStringWidth(strs []string) int {
 	return max
 }
 
-func maxFrequency(buckets []promBucket) float64 {
-	var max = buckets[0].count
-
-	for ix := 1; ix < len(buckets); ix++ {
-		d := buckets[ix].count - buckets[ix-1].count
-		if d > max {
-			max = d
-		}
+// maxFrequency returns the largest number of samples in a single bucket, the
+// length of the longest bar. It is at least 1, so that bars can be scaled by it
+// even if all buckets are empty.
+func maxFrequency(buckets []histogram.Bucket) float64 {
+	max, prev := float64(1), float64(0)
+	for _, b := range buckets {
+		max = math.Max(max, b.Count-prev)
+		prev = b.Count
 	}
-
 	return max
 }
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pstibrany/promfreq/histogram"
+)
+
+// writeTemp writes a file with the given name and content to a temporary
+// directory, which cleanup removes.
+func writeTemp(t *testing.T, name, content string) (path string, cleanup func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "promfreq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// runMain runs promfreq with the given arguments and input, and returns its
+// exit code and output.
+func runMain(t *testing.T, input string, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	code = run(args, strings.NewReader(input), &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+func TestPrometheusInputQuantileMethod(t *testing.T) {
+	const input = `x_bucket{le="1"} 2
+x_bucket{le="2"} 6
+x_bucket{le="3"} 10
+x_bucket{le="+Inf"} 10
+x_sum 15
+x_count 10
+`
+	for method, want := range map[string]string{
+		"interpolate": "p50=1.75 ",
+		"lower":       "p50=1 ",
+		"nearest":     "p50=2 ",
+	} {
+		code, stdout, stderr := runMain(t, input, "-input", "prometheus", "-quantile-method", method, "-quantiles", "0.5", "-compact")
+		if code != 0 {
+			t.Fatalf("%s: exit code %d: %s", method, code, stderr)
+		}
+		if !strings.Contains(stdout, want) {
+			t.Errorf("%s: got %q, want %q", method, stdout, want)
+		}
+	}
+}
+
+func TestMaxFrequency(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		counts []float64 // cumulative
+		want   float64
+	}{
+		{"all zero", []float64{0, 0, 0}, 1},
+		{"first tallest", []float64{5, 7, 8}, 5},
+	} {
+		buckets := make([]histogram.Bucket, len(tc.counts))
+		for ix, c := range tc.counts {
+			buckets[ix].Count = c
+		}
+		if got := maxFrequency(buckets); got != tc.want {
+			t.Errorf("%s: got %g, want %g", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestColumn(t *testing.T) {
+	for _, tc := range []struct {
+		size float64
+		want string
+	}{
+		{0, ""},
+		{3, "███"},
+		{3.5, "███▋"}, // partial boxes round up
+	} {
+		if got := column(tc.size, boxes); got != tc.want {
+			t.Errorf("column(%g) = %q, want %q", tc.size, got, tc.want)
+		}
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"-compact"},
+		{"-output", "json"},
+	} {
+		code, stdout, stderr := runMain(t, "", args...)
+		if code != 0 {
+			t.Errorf("%v: exit code %d: %s", args, code, stderr)
+		}
+		if strings.Contains(stdout, "NaN") {
+			t.Errorf("%v: NaN in output: %q", args, stdout)
+		}
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	for _, tc := range []struct {
+		input string // with \n line endings
+		args  []string
+	}{
+		{"1\n2\n3\n", []string{"-compact"}},
+		{"a,1\nb,2\nc,3\n", []string{"-compact", "-delimiter", ",", "-field", "2"}},
+		{"a 1\nb 2\nc 3\n", []string{"-compact", "-field", "2"}},
+		{"a,1\nb,2\nb,3\n", []string{"-compact", "-delimiter", ",", "-field", "2", "-filter", "col1==b"}},
+	} {
+		_, want, _ := runMain(t, tc.input, tc.args...)
+		for _, eol := range []string{"\r\n", "\r"} {
+			input := strings.Replace(tc.input, "\n", eol, -1)
+			code, got, stderr := runMain(t, input, tc.args...)
+			if code != 0 {
+				t.Errorf("%v with %q: exit code %d: %s", tc.args, eol, code, stderr)
+			} else if got != want {
+				t.Errorf("%v with %q: got %q, want %q", tc.args, eol, got, want)
+			}
+		}
+	}
+}
+
+func TestCommentsAndBlankLines(t *testing.T) {
+	const input = "# latency in seconds\n\n1\n  \n# more\n2\n\t\n3\n\n"
+	code, stdout, stderr := runMain(t, input, "-compact")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if !strings.HasPrefix(stdout, "count=3 ") {
+		t.Errorf("got %q, want count=3", stdout)
+	}
+
+	code, stdout, _ = runMain(t, "// note\n1\n", "-compact", "-comment", "//")
+	if code != 0 || !strings.HasPrefix(stdout, "count=1 ") {
+		t.Errorf("-comment //: exit code %d, got %q, want count=1", code, stdout)
+	}
+
+	code, _, stderr = runMain(t, "1\nx2\n3\n")
+	if code != exitInput {
+		t.Errorf("malformed line: exit code %d, want %d", code, exitInput)
+	}
+	if !strings.Contains(stderr, "line 2") {
+		t.Errorf("malformed line: error doesn't name line 2: %q", stderr)
+	}
+}
+
+func TestCountColumnsAligned(t *testing.T) {
+	const input = "1 1\n2 10\n3 100\n4 1000\n5 10000\n6 100000\n"
+	const want = `(-inf .. 1] .                                    1  (0.0 %)
+   (1 .. 2] .                                   10  (0.0 %)
+   (2 .. 3] .                                  100  (0.1 %)
+   (3 .. 4] :                                 1000  (0.9 %)
+   (4 .. 5] ###                              10000  (9.0 %)
+   (5 .. 6] ##############################  100000 (90.0 %)
+(6 .. +inf)                                      0  (0.0 %)
+`
+	code, stdout, stderr := runMain(t, input, "-weighted", "-buckets", "1,2,3,4,5,6", "-ascii")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	// Only the histogram, the summary follows after a blank line.
+	if got := stdout[:strings.Index(stdout, "\n\n")+1]; got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestValidateCompact(t *testing.T) {
+	code, stdout, stderr := runMain(t, "1\n2\n3\n4\n", "-exact", "-validate", "-compact", "-quantiles", "0.5")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	for _, want := range []string{" p50_estimated=", " p50_exact=2.5 ", " p50_error="} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("got %q, want it to contain %q", stdout, want)
+		}
+	}
+}
+
+func TestInvertedVertical(t *testing.T) {
+	const want = `       +
+       i
+       n
+   1 2 f
+  +------
+  |# #
+2 |  #
+`
+	code, stdout, stderr := runMain(t, "1\n2\n2\n", "-buckets", "1,2", "-column-width", "2", "-orientation", "vertical", "-invert", "-ascii")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if got := stdout[:strings.Index(stdout, "\n\n")+1]; got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAutoBucketsLessThan(t *testing.T) {
+	input := strings.Repeat("1\n2\n5\n20\n", 10)
+	for _, mode := range []string{"auto", "exponential-auto"} {
+		code, stdout, stderr := runMain(t, input, "-mode", mode, "-bucket-bound", "lt", "-compact")
+		if code != 0 {
+			t.Fatalf("%s: exit code %d: %s", mode, code, stderr)
+		}
+		if !strings.Contains(stdout, " overflow=0") || strings.Contains(stderr, "above the largest bucket boundary") {
+			t.Errorf("%s: largest sample is above the last bound: %q %q", mode, stdout, stderr)
+		}
+	}
+}
+
+func TestValidateCompare(t *testing.T) {
+	compareFile, cleanup := writeTemp(t, "b.txt", "10\n20\n30\n")
+	defer cleanup()
+
+	code, stdout, stderr := runMain(t, "1\n2\n3\n", "-exact", "-validate", "-quantiles", "0.5", "-compare", compareFile)
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	for _, want := range []string{"exact=2 ", "exact=20 "} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("got %q, want it to contain %q", stdout, want)
+		}
+	}
+}
+
+func TestCompareEmptyFile(t *testing.T) {
+	compareFile, cleanup := writeTemp(t, "empty.txt", "")
+	defer cleanup()
+
+	for _, args := range [][]string{nil, {"-compact"}} {
+		args = append(args, "-compare", compareFile)
+		code, stdout, stderr := runMain(t, "1\n2\n3\n", args...)
+		if code != 0 {
+			t.Fatalf("%v: exit code %d: %s", args, code, stderr)
+		}
+		if strings.Contains(stdout, "NaN") || strings.Contains(stdout, "compare") {
+			t.Errorf("%v: got %q, want only the input's statistics", args, stdout)
+		}
+	}
+}
+
+func TestCompareCompactPrefix(t *testing.T) {
+	compareFile, cleanup := writeTemp(t, "b.txt", "4\n5\n")
+	defer cleanup()
+
+	code, stdout, stderr := runMain(t, "1\n2\n3\n", "-compact", "-compare", compareFile)
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "count=3 ") || !strings.HasPrefix(lines[1], "compare_count=2 ") {
+		t.Errorf("got %q, want the input's and the compared file's statistics", stdout)
+	}
+}
+
+func TestPrometheusInputSummary(t *testing.T) {
+	const input = `x_bucket{le="1"} 2
+x_bucket{le="2"} 6
+x_bucket{le="+Inf"} 6
+x_sum 8
+x_count 6
+`
+	for _, args := range [][]string{nil, {"-compact"}, {"-extended-stats"}} {
+		args = append(args, "-input", "prometheus")
+		code, stdout, stderr := runMain(t, input, args...)
+		if code != 0 {
+			t.Fatalf("%v: exit code %d: %s", args, code, stderr)
+		}
+		if strings.Contains(stdout, "NaN") {
+			t.Errorf("%v: NaN in output: %q", args, stdout)
+		}
+	}
+}
+
+func TestUsageDefaults(t *testing.T) {
+	code, _, stderr := runMain(t, "", "-input", "prometheus", "-no-such-flag")
+	if code != exitUsage {
+		t.Errorf("exit code %d, want %d", code, exitUsage)
+	}
+	if !strings.Contains(stderr, `(default "samples")`) {
+		t.Errorf("usage doesn't show the default of -input: %q", stderr)
+	}
+}
+
+func TestStrictMonotonicInput(t *testing.T) {
+	const input = `x_bucket{le="1"} 2
+x_bucket{le="+Inf"} 4
+x_count 5
+`
+	code, _, stderr := runMain(t, input, "-input", "prometheus", "-compact")
+	if code != 0 || !strings.Contains(stderr, "Warning: x_count is 5") {
+		t.Errorf("exit code %d, got %q, want a warning", code, stderr)
+	}
+
+	code, _, stderr = runMain(t, input, "-input", "prometheus", "-strict-monotonic-input", "-compact")
+	if code != exitInput || !strings.Contains(stderr, "x_count is 5, but the +Inf bucket holds 4 samples") {
+		t.Errorf("exit code %d, got %q, want an error", code, stderr)
+	}
+}
+
+func TestVerticalLogScale(t *testing.T) {
+	const want = `1000 |      #
+ 100 |    # #
+  10 |  # # #
+   1 |# # # #
+     +----------
+      1 2 3 4 +
+              i
+              n
+              f
+`
+	code, stdout, stderr := runMain(t, "1 1\n2 10\n3 100\n4 1000\n", "-weighted", "-buckets", "1,2,3,4", "-column-width", "4", "-orientation", "vertical", "-log-scale", "-ascii")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if got := stdout[:strings.Index(stdout, "\n\n")+1]; got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPrometheusDelta(t *testing.T) {
+	before, cleanup := writeTemp(t, "before.txt", "x_bucket{le=\"1\"} 2\nx_bucket{le=\"2\"} 6\nx_bucket{le=\"+Inf\"} 6\nx_sum 9\nx_count 6\n")
+	defer cleanup()
+	after, cleanup := writeTemp(t, "after.txt", "x_bucket{le=\"1\"} 2\nx_bucket{le=\"2\"} 10\nx_bucket{le=\"+Inf\"} 12\nx_sum 21\nx_count 12\n")
+	defer cleanup()
+
+	code, stdout, stderr := runMain(t, "", "-input", "prometheus", "-delta", "-compact", "-quantiles", "0.5", before, after)
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if want := "count=6 p50=1.75 avg=2 "; !strings.HasPrefix(stdout, want) {
+		t.Errorf("got %q, want it to start with %q", stdout, want)
+	}
+
+	code, _, stderr = runMain(t, "", "-input", "prometheus", "-delta", after, before)
+	if code != exitInput || !strings.Contains(stderr, "counter reset") {
+		t.Errorf("exit code %d, got %q, want a counter reset error", code, stderr)
+	}
+}
+
+func TestBucketStatsFormat(t *testing.T) {
+	code, stdout, stderr := runMain(t, "1ms\n1.5ms\n20ms\n", "-unit", "duration", "-bucket-stats", "-buckets", "10ms,100ms")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if want := "min=1ms mean=1.25ms max=1.5ms"; !strings.Contains(stdout, want) {
+		t.Errorf("got %q, want it to contain %q", stdout, want)
+	}
+}
+
+func TestNegativeWidth(t *testing.T) {
+	for _, flag := range []string{"-column-width", "-total-width"} {
+		code, _, stderr := runMain(t, "1\n", flag, "-5")
+		if code != exitUsage {
+			t.Errorf("%s -5: exit code %d, want %d: %s", flag, code, exitUsage, stderr)
+		}
+	}
+}
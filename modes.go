@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/pstibrany/promfreq/histogram"
+)
+
+// bucketMode describes one way of choosing bucket boundaries.
+type bucketMode struct {
+	name        string
+	flags       string
+	description string
+	example     string
+}
+
+// bucketModes lists the bucketing modes in the order they take precedence.
+var bucketModes = []bucketMode{
+	{
+		name:        "explicit",
+		flags:       "-buckets",
+		description: "Comma separated bucket boundaries, used as given.",
+		example:     "-buckets 0.1,0.25,0.5,1,2.5",
+	},
+	{
+		name:        "relative-error",
+		flags:       "-relative-error, -start, -max",
+		description: "Exponential buckets from -start to -max, guaranteeing the given relative error of quantile estimates.",
+		example:     "-relative-error 0.01 -start 0.001 -max 10",
+	},
+	{
+		name:        "log-bins",
+		flags:       "-log-bins, -start, -width, -count",
+		description: "Buckets of equal width in log10 space, starting at -start; -width is in decades.",
+		example:     "-log-bins -start 1 -width 0.5 -count 8",
+	},
+	{
+		name:        "linear (lin)",
+		flags:       "-mode, -start, -width, -count",
+		description: "Buckets of equal width. This is the default.",
+		example:     "-mode linear -start 0 -width 10 -count 10",
+	},
+	{
+		name:        "exponential (exp)",
+		flags:       "-mode, -start, -factor, -count",
+		description: "Each boundary is -factor times the previous one.",
+		example:     "-mode exp -start 0.001 -factor 2 -count 12",
+	},
+	{
+		name:        "exponential-signed",
+		flags:       "-mode, -start, -factor, -count",
+		description: "Exponential buckets mirrored around zero, for signed data; -count is the number of positive boundaries.",
+		example:     "-mode exponential-signed -start 0.1 -factor 10 -count 4",
+	},
+	{
+		name:        "auto",
+		flags:       "-mode",
+		description: "Buckets of equal, round width chosen from the data by the Freedman–Diaconis rule, or Sturges' rule for small inputs. Reads all input into memory first.",
+		example:     "-mode auto",
+	},
+	{
+		name:        "exponential-auto",
+		flags:       "-mode, -count",
+		description: "-count exponential buckets spanning the smallest to the largest sample, which must be positive. Reads all input into memory first.",
+		example:     "-mode exponential-auto -count 20",
+	},
+}
+
+// printModes explains every bucketing mode.
+func printModes(out io.Writer) {
+	fmt.Fprintln(out, "Bucketing modes, in order of precedence:")
+	for _, m := range bucketModes {
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, m.name)
+		fmt.Fprintln(out, "    "+m.description)
+		fmt.Fprintln(out, "    Flags:   "+m.flags)
+		fmt.Fprintln(out, "    Example: promfreq "+m.example)
+	}
+}
+
+// autoMode reports whether the buckets are chosen from the input, which the
+// auto modes do unless a mode of higher precedence is given.
+func (c *config) autoMode() bool {
+	return c.explicitBounds == "" && c.relativeError == 0 && !c.logBins && (c.mode == "auto" || c.mode == "exponential-auto")
+}
+
+// bounds returns the bucket boundaries of the mode chosen by the flags. In the
+// auto modes, there are none until chooseBounds is called with the samples.
+func (c *config) bounds(stderr io.Writer) ([]float64, error) {
+	var bounds []float64
+	var err error
+
+	if c.explicitBounds != "" {
+		bounds, err = histogram.ParseBucketBoundaries(c.explicitBounds, c.number)
+	} else if c.relativeError != 0 {
+		bounds, err = histogram.RelativeErrorBuckets(c.start, c.maxValue, c.relativeError)
+	} else if c.logBins {
+		bounds, err = histogram.LogBuckets(c.start, c.width, c.count)
+	} else if c.mode == "linear" || c.mode == "lin" {
+		bounds, err = histogram.LinearBuckets(c.start, c.width, c.count)
+	} else if c.mode == "exponential" || c.mode == "exp" {
+		bounds, err = histogram.ExponentialBuckets(c.start, c.factor, c.count)
+	} else if c.mode == "exponential-signed" {
+		bounds, err = histogram.SignedExponentialBuckets(c.start, c.factor, c.count)
+	}
+
+	if err != nil {
+		return nil, fail(exitUsage, "Failed to create buckets:", err)
+	}
+	return c.adjustBounds(bounds, stderr), nil
+}
+
+// chooseBounds chooses the buckets of the auto modes from the samples, and
+// observes the samples in h with them.
+func (c *config) chooseBounds(h *histogram.Histogram, samples sampleBuffer, stderr io.Writer) error {
+	var bounds []float64
+	var err error
+	if c.mode == "exponential-auto" {
+		bounds, err = histogram.ExponentialAutoBuckets(samples, c.count)
+	} else {
+		bounds, err = histogram.AutoBuckets(samples)
+	}
+	if err != nil {
+		return fail(exitInput, "Failed to create buckets:", err)
+	}
+	// The largest sample is the last bound, which is above it with
+	// -bucket-bound lt. Add another bucket for it.
+	if h.LessThan && len(bounds) > 0 {
+		bounds = append(bounds, nextBound(bounds, c.mode == "exponential-auto"))
+	}
+	empty := histogram.New(c.adjustBounds(bounds, stderr))
+	h.Bounds, h.Buckets = empty.Bounds, empty.Buckets
+	for _, s := range samples {
+		h.Observe(s.Value, s.Weight)
+	}
+	return nil
+}
+
+// adjustBounds merges close boundaries and rounds them with -integer-bounds.
+// It applies to all modes, including the buckets the auto modes choose.
+func (c *config) adjustBounds(bounds []float64, stderr io.Writer) []float64 {
+	bounds, merged := histogram.MergeCloseBuckets(bounds, c.boundsEpsilon)
+	for _, m := range merged {
+		fmt.Fprintf(stderr, "Warning: bucket boundaries %g and %g are closer than %g, merged into %g.\n", m[0], m[1], c.boundsEpsilon, m[0])
+	}
+
+	if c.integerBounds {
+		bounds = histogram.RoundBuckets(bounds)
+	}
+	return bounds
+}
+
+// nextBound returns the bound following the sorted bounds, as far from the
+// last one as that is from the one before, or by the same factor if the bounds
+// are exponential. A single bound is followed by twice its value, or 1 for 0.
+func nextBound(bounds []float64, exponential bool) float64 {
+	last := bounds[len(bounds)-1]
+	if len(bounds) == 1 {
+		if last == 0 {
+			return 1
+		}
+		return last + math.Abs(last)
+	}
+
+	prev := bounds[len(bounds)-2]
+	if exponential {
+		return histogram.TrimFloatNoise(last * last / prev)
+	}
+	return histogram.TrimFloatNoise(last + (last - prev))
+}
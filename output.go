@@ -0,0 +1,678 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+
+	"github.com/pstibrany/promfreq/histogram"
+)
+
+// tableBorders are the characters printTable draws borders with.
+type tableBorders struct {
+	horizontal, vertical                  string
+	topLeft, topMiddle, topRight          string
+	left, middle, right                   string
+	bottomLeft, bottomMiddle, bottomRight string
+}
+
+var boxBorders = tableBorders{
+	horizontal: "─", vertical: "│",
+	topLeft: "┌", topMiddle: "┬", topRight: "┐",
+	left: "├", middle: "┼", right: "┤",
+	bottomLeft: "└", bottomMiddle: "┴", bottomRight: "┘",
+}
+
+var asciiBorders = tableBorders{
+	horizontal: "-", vertical: "|",
+	topLeft: "+", topMiddle: "+", topRight: "+",
+	left: "+", middle: "+", right: "+",
+	bottomLeft: "+", bottomMiddle: "+", bottomRight: "+",
+}
+
+// printTable displays the histogram as a bordered table with range, count,
+// percent and bar columns. Of the options, only the bar width, the value
+// format, the duration, cumulative and ascii are used.
+func printTable(out io.Writer, buckets []histogram.Bucket, samples float64, opts histogramOptions, borders tableBorders) {
+	countHeader := "count"
+	if opts.duration > 0 {
+		countHeader = "rate"
+	}
+	rows := [][]string{{"range", countHeader, "percent", "histogram"}}
+
+	labels := bucketLabels(buckets, opts)
+	maxFreq := maxFrequency(buckets)
+	if opts.cumulative || opts.normalizeTotal {
+		maxFreq = samples
+	}
+	prev := float64(0)
+	for ix := range buckets {
+		shown := buckets[ix].Count - prev
+		prev = buckets[ix].Count
+		if opts.cumulative {
+			shown = buckets[ix].Count
+		}
+
+		rows = append(rows, []string{
+			labels[ix],
+			opts.formatCount(shown),
+			fmt.Sprintf("%0.1f %%", 100*shown/samples),
+			column(shown/maxFreq*opts.barWidth, opts.boxes()),
+		})
+	}
+
+	widths := make([]int, len(rows[0]))
+	for col := range widths {
+		for _, row := range rows {
+			if w := runewidth.StringWidth(row[col]); w > widths[col] {
+				widths[col] = w
+			}
+		}
+	}
+
+	rule := func(left, middle, right string) {
+		cells := make([]string, len(widths))
+		for col, w := range widths {
+			cells[col] = strings.Repeat(borders.horizontal, w+2)
+		}
+		fmt.Fprintln(out, left+strings.Join(cells, middle)+right)
+	}
+
+	rule(borders.topLeft, borders.topMiddle, borders.topRight)
+	for ix, row := range rows {
+		cells := make([]string, len(row))
+		for col, cell := range row {
+			// Numbers are right-aligned, the header and the bars left-aligned.
+			if ix > 0 && col < len(row)-1 {
+				cells[col] = just(cell, widths[col])
+			} else {
+				cells[col] = fill(cell, widths[col])
+			}
+		}
+		fmt.Fprintln(out, borders.vertical+" "+strings.Join(cells, " "+borders.vertical+" ")+" "+borders.vertical)
+
+		if ix == 0 {
+			rule(borders.left, borders.middle, borders.right)
+		}
+	}
+	rule(borders.bottomLeft, borders.bottomMiddle, borders.bottomRight)
+}
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+var (
+	verticalBoxes      = []string{"▁", "▂", "▃", "▄", "▅", "▆", "▇", "█"}
+	asciiVerticalBoxes = []string{".", ":", "=", "#"}
+
+	// Unicode only has upper one eighth and half blocks.
+	invertedBoxes      = []string{"▔", "▀", "█"}
+	asciiInvertedBoxes = []string{"'", "=", "#"}
+)
+
+// printVertical displays the histogram with a vertical bar per bucket, bar
+// width used as the height. Upper bounds of the buckets are printed rotated
+// beneath the bars, and the largest count on the axis. With invert, the axis
+// and labels are at the top and the bars hang down. With logScale, heights
+// are logarithmic and the axis is labeled with powers of ten. Of the other
+// options, the bar width, the value format, cumulative, normalizeTotal, ascii
+// and hideEmpty are used.
+func printVertical(out io.Writer, buckets []histogram.Bucket, samples float64, opts histogramOptions) {
+	boxes, inf, axis, corner, rule := verticalBoxes, "∞", "│", "└", "─"
+	if opts.ascii {
+		boxes, inf, axis, corner, rule = asciiVerticalBoxes, "inf", "|", "+", "-"
+	}
+	if opts.invert {
+		boxes, corner = invertedBoxes, "┌"
+		if opts.ascii {
+			boxes, corner = asciiInvertedBoxes, "+"
+		}
+	}
+
+	var heights []float64
+	var labels [][]rune
+	prev := float64(0)
+	for _, b := range buckets {
+		shown := b.Count - prev
+		prev = b.Count
+		if opts.hideEmpty && shown == 0 {
+			continue
+		}
+		if opts.cumulative {
+			shown = b.Count
+		}
+		heights = append(heights, shown)
+
+		label := "+" + inf
+		if !math.IsInf(b.UpperBound, +1) {
+			label = opts.format(b.UpperBound)
+		}
+		labels = append(labels, []rune(label))
+	}
+
+	maxFreq := maxFrequency(buckets)
+	if opts.cumulative || opts.normalizeTotal {
+		maxFreq = samples
+	}
+
+	scale := func(v float64) float64 { return v }
+	if opts.logScale {
+		// A count of 1 is one decade high, so that it doesn't vanish.
+		scale = func(v float64) float64 {
+			if v < 1 {
+				return 0
+			}
+			return math.Log10(v) + 1
+		}
+	}
+
+	// Row 0 is next to the axis, the largest count is written beside the
+	// last. With logScale, powers of ten are written beside the rows that
+	// bars of that height end in, unless a larger one already is.
+	rows := int(math.Max(opts.barWidth, 1))
+	axisLabels := map[int]string{rows - 1: opts.formatCount(maxFreq)}
+	if opts.logScale {
+		decades := int(math.Ceil(math.Log10(maxFreq)))
+		for d := decades - 1; d >= 0; d-- {
+			row := int(math.Ceil(scale(math.Pow(10, float64(d)))/scale(maxFreq)*float64(rows))) - 1
+			if _, ok := axisLabels[row]; !ok {
+				axisLabels[row] = opts.formatCount(math.Pow(10, float64(d)))
+			}
+		}
+	}
+	axisWidth := 0
+	for _, l := range axisLabels {
+		if w := runewidth.StringWidth(l); w > axisWidth {
+			axisWidth = w
+		}
+	}
+
+	bars := make([]string, rows)
+	for row := range bars {
+		prefix := just(axisLabels[row], axisWidth)
+
+		cells := make([]string, len(heights))
+		for ix, height := range heights {
+			level := scale(height)/scale(maxFreq)*float64(rows) - float64(row)
+			switch {
+			case level >= 1:
+				cells[ix] = boxes[len(boxes)-1]
+			case level > 0:
+				cells[ix] = boxes[int(level*float64(len(boxes)))]
+			default:
+				cells[ix] = " "
+			}
+		}
+		bars[row] = strings.TrimRight(prefix+" "+axis+strings.Join(cells, " "), " ")
+	}
+	axisLine := strings.Repeat(" ", axisWidth+1) + corner + strings.Repeat(rule, 2*len(heights))
+
+	longest := 0
+	for _, l := range labels {
+		if len(l) > longest {
+			longest = len(l)
+		}
+	}
+	// Labels start at the axis, so above it they are aligned to the bottom.
+	labelRows := make([]string, longest)
+	for row := range labelRows {
+		cells := make([]string, len(labels))
+		for ix, l := range labels {
+			pos := row
+			if opts.invert {
+				pos = row - (longest - len(l))
+			}
+			cells[ix] = " "
+			if pos >= 0 && pos < len(l) {
+				cells[ix] = string(l[pos])
+			}
+		}
+		labelRows[row] = strings.TrimRight(strings.Repeat(" ", axisWidth+2)+strings.Join(cells, " "), " ")
+	}
+
+	if opts.invert {
+		for _, l := range labelRows {
+			fmt.Fprintln(out, l)
+		}
+		fmt.Fprintln(out, axisLine)
+		for _, b := range bars {
+			fmt.Fprintln(out, b)
+		}
+		return
+	}
+
+	for row := rows - 1; row >= 0; row-- {
+		fmt.Fprintln(out, bars[row])
+	}
+	fmt.Fprintln(out, axisLine)
+	for _, l := range labelRows {
+		fmt.Fprintln(out, l)
+	}
+}
+
+var (
+	compareBoxes      = []string{"░"}
+	asciiCompareBoxes = []string{"-"}
+)
+
+// printComparison displays two histograms with the same buckets, the bar of
+// the second one beneath the bar of the first, followed by the change from the
+// first to the second. Bars show the percentage of each histogram's samples,
+// so that inputs of different sizes can be compared. Of the options, the
+// widths, the value and count formats, cumulative, normalizeTotal, ascii,
+// hideEmpty and color are used.
+func printComparison(out io.Writer, buckets, others []histogram.Bucket, opts histogramOptions) {
+	allLabels := bucketLabels(buckets, opts)
+	samples, otherSamples := buckets[len(buckets)-1].Count, others[len(others)-1].Count
+
+	var (
+		labels           []string
+		counts, percents [2][]string
+		shares           [2][]float64
+		deltas           []string
+		maxShare         float64
+	)
+
+	prev, otherPrev := float64(0), float64(0)
+	for ix := range buckets {
+		shown, otherShown := buckets[ix].Count-prev, others[ix].Count-otherPrev
+		prev, otherPrev = buckets[ix].Count, others[ix].Count
+
+		if opts.hideEmpty && shown == 0 && otherShown == 0 {
+			continue
+		}
+		if opts.cumulative {
+			shown, otherShown = buckets[ix].Count, others[ix].Count
+		}
+		labels = append(labels, allLabels[ix])
+
+		for i, n := range []float64{shown, otherShown} {
+			share := n / []float64{samples, otherSamples}[i]
+			if math.IsNaN(share) {
+				share = 0
+			}
+			counts[i] = append(counts[i], opts.formatCount(n))
+			percents[i] = append(percents[i], fmt.Sprintf("(%0.1f %%)", 100*share))
+			shares[i] = append(shares[i], share)
+			maxShare = math.Max(maxShare, share)
+		}
+
+		sign := "+"
+		if otherShown < shown {
+			sign = "-"
+		}
+		delta := shares[1][len(shares[1])-1] - shares[0][len(shares[0])-1]
+		deltas = append(deltas, fmt.Sprintf("%s%s (%+0.1f pp)", sign, opts.formatCount(math.Abs(otherShown-shown)), 100*delta))
+	}
+
+	var (
+		labelWidth   = maxStringWidth(labels)
+		countWidth   = maxInt(maxStringWidth(counts[0]), maxStringWidth(counts[1]))
+		percentWidth = maxInt(maxStringWidth(percents[0]), maxStringWidth(percents[1]))
+		deltaWidth   = maxStringWidth(deltas)
+		barWidth     = opts.barWidth
+		glyphs       = [2][]string{opts.boxes(), compareBoxes}
+	)
+	if opts.ascii {
+		glyphs[1] = asciiCompareBoxes
+	}
+
+	if opts.totalWidth > 0 {
+		reserved := labelWidth + countWidth + percentWidth + deltaWidth + 5
+		barWidth = math.Max(float64(opts.totalWidth-reserved), 0)
+	}
+
+	for row := range labels {
+		for i := range glyphs {
+			prefix, suffix := paddedString(labels[row], labelWidth, opts.justify), ""
+			if i == 1 {
+				prefix, suffix = strings.Repeat(" ", labelWidth), " "+deltas[row]
+			}
+
+			size := shares[i][row]
+			if !opts.normalizeTotal && maxShare > 0 {
+				size /= maxShare
+			}
+			bar := fill(column(size*barWidth, glyphs[i]), int(barWidth)+1)
+			if opts.color {
+				bar = colorize(bar, size)
+			}
+
+			fmt.Fprintln(out, strings.TrimRight(fmt.Sprintf("%s %s %s %s%s", prefix, bar, just(counts[i][row], countWidth), just(percents[i][row], percentWidth), suffix), " "))
+		}
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// printPrometheusHistogram writes the histogram as a Prometheus histogram
+// metric in the text exposition format: cumulative _bucket series, ending
+// with le="+Inf", followed by _sum and _count. A non-empty help is written as
+// the metric's HELP line.
+func printPrometheusHistogram(out io.Writer, h *histogram.Histogram, name, help string) {
+	printPrometheusHelp(out, name, help)
+	fmt.Fprintf(out, "# TYPE %s histogram\n", name)
+	for _, b := range h.Buckets {
+		fmt.Fprintf(out, "%s_bucket{le=\"%s\"} %s\n", name, formatPrometheusValue(b.UpperBound), formatPrometheusValue(b.Count))
+	}
+	fmt.Fprintf(out, "%s_sum %s\n", name, formatPrometheusValue(h.Sum))
+	fmt.Fprintf(out, "%s_count %s\n", name, formatPrometheusValue(h.Count))
+}
+
+// printPrometheusSummary writes summary statistics as individual gauges in
+// the Prometheus text exposition format, suitable for pushing to a
+// Pushgateway. Quantile gauges are named like promfreq_p99_9, as metric names
+// cannot contain dots. A non-empty help is written as the HELP line of every
+// gauge.
+func printPrometheusSummary(out io.Writer, h *histogram.Histogram, quantiles []float64, help string) {
+	type gauge struct {
+		name  string
+		value float64
+	}
+	gauges := []gauge{{"count", h.Count}}
+	for _, q := range quantiles {
+		gauges = append(gauges, gauge{strings.Replace(quantileName(q), ".", "_", -1), h.Quantile(q)})
+	}
+	gauges = append(gauges,
+		gauge{"avg", h.Sum / h.Count},
+		gauge{"min", h.Min},
+		gauge{"max", h.Max},
+	)
+
+	for _, g := range gauges {
+		printPrometheusHelp(out, "promfreq_"+g.name, help)
+		fmt.Fprintf(out, "# TYPE promfreq_%s gauge\n", g.name)
+		fmt.Fprintf(out, "promfreq_%s %s\n", g.name, formatPrometheusValue(g.value))
+	}
+}
+
+// printPrometheusHelp writes the HELP line of a metric, unless help is empty.
+// Backslashes and line feeds are escaped as the text format requires.
+func printPrometheusHelp(out io.Writer, name, help string) {
+	if help == "" {
+		return
+	}
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(out, "# HELP %s %s\n", name, help)
+}
+
+// printWeighted writes one "value count" line per non-empty bucket, the
+// format accepted as pre-aggregated input. Each bucket is represented by the
+// midpoint of its range, narrowed to the observed min and max, so the
+// outermost buckets have finite midpoints. All samples in a bucket collapse
+// onto that midpoint: re-reading the output reproduces the bucket counts
+// exactly, but sum, average and the other moments are only approximated, with
+// an error bounded by half the bucket width.
+func printWeighted(out io.Writer, h *histogram.Histogram) {
+	prev := float64(0)
+	for ix, b := range h.Buckets {
+		count := b.Count - prev
+		prev = b.Count
+		if count == 0 {
+			continue
+		}
+
+		// Histograms read from exposition data have no Min or Max; their
+		// outer buckets are then represented by their finite bound.
+		lower, upper := h.Min, b.UpperBound
+		if ix > 0 {
+			lower = h.Buckets[ix-1].UpperBound
+			if !math.IsNaN(h.Min) {
+				lower = math.Max(lower, h.Min)
+			}
+		}
+		if !math.IsNaN(h.Max) {
+			upper = math.Min(upper, h.Max)
+		}
+		if math.IsNaN(lower) {
+			lower = upper
+		}
+		if math.IsInf(upper, 1) {
+			upper = lower
+		}
+
+		fmt.Fprintf(out, "%g %.0f\n", lower+(upper-lower)/2, count)
+	}
+}
+
+// jsonFloat is a float64 that encodes the special values JSON has no literal
+// for as the strings "+Inf", "-Inf" and "NaN", the way Prometheus does.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return json.Marshal(formatPrometheusValue(v))
+	}
+	return json.Marshal(v)
+}
+
+type jsonBucket struct {
+	LE          jsonFloat `json:"le"`
+	Count       jsonFloat `json:"count"`        // cumulative
+	BucketCount jsonFloat `json:"bucket_count"` // in this bucket only
+}
+
+type jsonSummary struct {
+	Count     jsonFloat            `json:"count"`
+	Sum       jsonFloat            `json:"sum"`
+	Avg       jsonFloat            `json:"avg"`
+	Min       jsonFloat            `json:"min"`
+	Max       jsonFloat            `json:"max"`
+	Quantiles map[string]jsonFloat `json:"quantiles"`
+}
+
+type jsonReport struct {
+	Title   string       `json:"title,omitempty"`
+	Buckets []jsonBucket `json:"buckets"`
+	Summary jsonSummary  `json:"summary"`
+}
+
+// printJSON writes the buckets and the summary as a JSON document, with the
+// title if it isn't empty.
+func printJSON(out io.Writer, h *histogram.Histogram, quantiles []float64, title string) error {
+	report := jsonReport{
+		Title: title,
+		Summary: jsonSummary{
+			Count:     jsonFloat(h.Count),
+			Sum:       jsonFloat(h.Sum),
+			Avg:       jsonFloat(h.Sum / h.Count),
+			Min:       jsonFloat(h.Min),
+			Max:       jsonFloat(h.Max),
+			Quantiles: map[string]jsonFloat{},
+		},
+	}
+	for _, q := range quantiles {
+		report.Summary.Quantiles[quantileName(q)] = jsonFloat(h.Quantile(q))
+	}
+
+	prev := float64(0)
+	for _, b := range h.Buckets {
+		report.Buckets = append(report.Buckets, jsonBucket{
+			LE:          jsonFloat(b.UpperBound),
+			Count:       jsonFloat(b.Count),
+			BucketCount: jsonFloat(b.Count - prev),
+		})
+		prev = b.Count
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// formatPrometheusValue formats a sample value the way the Prometheus text
+// format expects it, including the special +Inf, -Inf and NaN values.
+func formatPrometheusValue(v float64) string {
+	switch {
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// renderer draws the histogram, next to that of the -compare file if there is
+// one, in the output format the flags ask for.
+type renderer struct {
+	c      *config
+	out    io.Writer
+	screen *liveScreen // redraws in place, if live on a terminal
+
+	h           *histogram.Histogram
+	histOpts    histogramOptions
+	summaryOpts summaryOptions
+
+	// other is the histogram of the -compare file, once it has been read, and
+	// otherChecks its -validate checks.
+	other       *histogram.Histogram
+	otherChecks []quantileCheck
+
+	err error // of the last rendering
+}
+
+// newRenderer returns a renderer of h to out.
+func (c *config) newRenderer(h *histogram.Histogram, out io.Writer) *renderer {
+	histOpts := histogramOptions{
+		barWidth:    float64(c.columnWidth),
+		justify:     true,
+		totalWidth:  c.totalWidth,
+		alignCounts: c.alignCounts,
+		bucketStats: c.bucketStats,
+		runningPct:  c.runningPct,
+		cumulative:  c.cumulative,
+		format:      c.format,
+		duration:    c.duration,
+		groupDigits: c.groupDigits,
+		ascii:       c.ascii,
+		barChar:     c.barChar,
+		hideEmpty:   c.hideEmpty,
+		color:       c.color == "always" || c.color == "auto" && isTerminal(out),
+		invert:      c.invert,
+		logScale:    c.logScale,
+
+		normalizeTotal:      c.normalize == "total",
+		lessThan:            c.bucketBound == "lt",
+		highlightCumulative: c.highlightCumulative,
+	}
+
+	// Without an explicit width, bars fill the terminal, if there is one.
+	if histOpts.totalWidth == 0 && !isFlagSet(c.fs, "column-width") {
+		histOpts.totalWidth = terminalWidth(out)
+	}
+
+	summaryOpts := summaryOptions{
+		extended: c.extendedStats,
+		compact:  c.compact,
+		duration: c.duration,
+
+		quantiles: c.quantiles,
+		precision: c.precision,
+		format:    c.summaryFormat,
+
+		trimmed: isFlagSet(c.fs, "trim"),
+		trim:    c.trim,
+
+		labels: histOpts,
+	}
+
+	r := &renderer{c: c, out: out, h: h, histOpts: histOpts, summaryOpts: summaryOpts}
+	if isTerminal(out) && (c.follow || c.flushEvery > 0 && !c.valueFrequency) {
+		r.screen = &liveScreen{out: out}
+	}
+	return r
+}
+
+// draw renders to the output, over the last drawing if live on a terminal.
+func (r *renderer) draw() {
+	if r.screen != nil {
+		r.screen.draw(r.render)
+		return
+	}
+	r.render(r.out)
+}
+
+// render writes the histogram and summary to out.
+func (r *renderer) render(out io.Writer) {
+	c, h := r.c, r.h
+	showHistogram := !c.compact && !c.quiet
+
+	switch c.output {
+	case "prometheus":
+		printPrometheusHistogram(out, h, c.metricName, c.title)
+	case "prometheus-summary":
+		printPrometheusSummary(out, h, c.quantiles, c.title)
+	case "weighted":
+		printWeighted(out, h)
+	case "json":
+		if err := printJSON(out, h, c.quantiles, c.title); err != nil {
+			r.err = fail(exitError, "Failed to write JSON:", err)
+		}
+	case "ascii-table":
+		if !c.compact {
+			printTitle(out, c.title, r.histOpts.color)
+		}
+		if showHistogram {
+			borders := boxBorders
+			if c.ascii {
+				borders = asciiBorders
+			}
+			printTable(out, h.Buckets, h.Count, r.histOpts, borders)
+		}
+		printSummary(out, h, r.summaryOpts)
+	default:
+		if !c.compact {
+			printTitle(out, c.title, r.histOpts.color)
+		}
+		if r.other != nil {
+			if showHistogram {
+				printComparison(out, h.Buckets, r.other.Buckets, r.histOpts)
+			}
+			printSummary(out, h, r.summaryOpts)
+			otherOpts := r.summaryOpts
+			otherOpts.heading = "compared to " + c.compareFile
+			otherOpts.prefix = "compare_"
+			otherOpts.checks = r.otherChecks
+			printSummary(out, r.other, otherOpts)
+			break
+		}
+		if showHistogram {
+			if c.orientation == "vertical" {
+				printVertical(out, h.Buckets, h.Count, r.histOpts)
+			} else {
+				printHistogram(out, h.Buckets, h.Count, r.histOpts)
+			}
+		}
+		printSummary(out, h, r.summaryOpts)
+		if c.percentileTable {
+			printPercentileTable(out, h, c.percentileStep, r.summaryOpts)
+		}
+	}
+}
+
+// check compares the estimated quantiles with the exact ones, which are
+// known from buf, the samples of the auto modes, or with -exact.
+func (r *renderer) check(buf sampleBuffer, stderr io.Writer) {
+	if !r.h.Exact && !r.c.autoMode() {
+		fmt.Fprintln(stderr, "Nothing to validate: exact quantiles are only known with -exact or -mode auto.")
+	}
+	r.summaryOpts.checks = checkQuantiles(r.h, buf, r.c.quantiles)
+	r.summaryOpts.tolerance = r.c.validateTolerance
+	if r.other != nil {
+		// The samples of the -compare file are only known with -exact.
+		r.otherChecks = checkQuantiles(r.other, nil, r.c.quantiles)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// lineParser extracts a sample from a single line of input.
+type lineParser struct {
+	delimiter string  // field delimiter, runs of whitespace if empty
+	field     int     // 1-based field holding the sample, whole line if 0
+	filter    *filter // optional predicate a line must satisfy to be used
+
+	colonValue bool // use only the part after the last colon, as in "name:0.25"
+	weighted   bool // lines are "value weight" pairs
+
+	positiveOnly bool // reject samples <= 0, which have no logarithm
+
+	number numberParser // parses samples, plain numbers if nil
+}
+
+// parse returns the sample found on the line and its weight, which is 1 unless
+// the input is weighted. If the line is rejected by the filter, ok is false.
+func (p *lineParser) parse(line string) (sample, weight float64, ok bool, err error) {
+	if p.weighted {
+		return p.parseWeighted(line)
+	}
+	return p.parseUnweighted(line)
+}
+
+// parseUnweighted parses a line holding a single sample, which has weight 1.
+func (p *lineParser) parseUnweighted(line string) (sample, weight float64, ok bool, err error) {
+	var fields []string
+	if p.field > 0 || p.filter != nil {
+		fields = p.split(line)
+	}
+
+	if p.filter != nil && !p.filter.match(fields) {
+		return 0, 0, false, nil
+	}
+
+	v := line
+	if p.field > 0 {
+		if p.field > len(fields) {
+			return 0, 0, false, fmt.Errorf("field %d not found in input: %q", p.field, line)
+		}
+		v = fields[p.field-1]
+	}
+
+	if p.colonValue {
+		v = v[strings.LastIndex(v, ":")+1:]
+	}
+
+	sample, err = p.parseSample(v)
+	if err != nil {
+		if p.field > 0 {
+			err = fmt.Errorf("field %d: %v", p.field, err)
+		}
+		return 0, 0, false, err
+	}
+	return sample, 1, true, nil
+}
+
+// parseWeighted parses a "value weight" line. The filter, delimiter and
+// colonValue apply as they do to unweighted lines.
+func (p *lineParser) parseWeighted(line string) (sample, weight float64, ok bool, err error) {
+	fields := p.split(line)
+	if p.filter != nil && !p.filter.match(fields) {
+		return 0, 0, false, nil
+	}
+	if len(fields) != 2 {
+		return 0, 0, false, fmt.Errorf("expected value and weight, found: %q", line)
+	}
+
+	v := fields[0]
+	if p.colonValue {
+		v = v[strings.LastIndex(v, ":")+1:]
+	}
+
+	sample, err = p.parseSample(v)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	weight, err = parseWeight(fields[1])
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return sample, weight, true, nil
+}
+
+// parseWeight parses the number of occurrences of a value, which must be a
+// non-negative integer.
+func parseWeight(v string) (float64, error) {
+	w, err := strconv.ParseFloat(v, 64)
+	if err != nil || w < 0 || math.IsInf(w, 0) || w != math.Trunc(w) {
+		return 0, fmt.Errorf("found invalid weight, expected a non-negative integer: %s", v)
+	}
+	return w, nil
+}
+
+func (p *lineParser) parseSample(v string) (float64, error) {
+	number := p.number
+	if number == nil {
+		number = parsePlain
+	}
+
+	v = strings.TrimSpace(v)
+	sample, err := number(v)
+	if err != nil {
+		if ue, ok := err.(*unitError); ok {
+			return 0, ue
+		}
+		return 0, fmt.Errorf("found non-numerical input: %s", v)
+	}
+	if p.positiveOnly && !(sample > 0) {
+		return 0, fmt.Errorf("found non-positive input, which cannot be binned in log space: %s", v)
+	}
+	return sample, nil
+}
+
+// looksWeighted reports whether the line consists of a number followed by an
+// integer, which is how pre-aggregated "value weight" input looks.
+func looksWeighted(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return false
+	}
+	if _, err := strconv.ParseFloat(fields[0], 64); err != nil {
+		return false
+	}
+	_, err := parseWeight(fields[1])
+	return err == nil
+}
+
+func (p *lineParser) split(line string) []string {
+	if p.delimiter == "" {
+		return strings.Fields(line)
+	}
+
+	fields := strings.Split(line, p.delimiter)
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields
+}
+
+// filter is a predicate on a single field of a line, such as "col3==200".
+type filter struct {
+	column  int // 1-based
+	op      string
+	operand string
+}
+
+var filterRegexp = regexp.MustCompile(`^col(\d+)\s*(==|!=|<|>)\s*(.*)$`)
+
+// parseFilter parses expressions of the form colN<op>value, where op is one of
+// ==, !=, < or >.
+func parseFilter(expr string) (*filter, error) {
+	m := filterRegexp.FindStringSubmatch(strings.TrimSpace(expr))
+	if m == nil {
+		return nil, fmt.Errorf("invalid filter %q, expected colN==value, colN!=value, colN<value or colN>value", expr)
+	}
+
+	column, err := strconv.Atoi(m[1])
+	if err != nil || column < 1 {
+		return nil, fmt.Errorf("invalid filter column in %q", expr)
+	}
+
+	f := &filter{column: column, op: m[2], operand: strings.TrimSpace(m[3])}
+	if f.op == "<" || f.op == ">" {
+		if _, err := strconv.ParseFloat(f.operand, 64); err != nil {
+			return nil, fmt.Errorf("filter %q needs a numeric operand", expr)
+		}
+	}
+	return f, nil
+}
+
+// match reports whether the fields satisfy the filter. Equality compares
+// numerically when both sides are numbers, and as strings otherwise. Lines
+// without the filtered column never match.
+func (f *filter) match(fields []string) bool {
+	if f.column > len(fields) {
+		return false
+	}
+
+	value := fields[f.column-1]
+	a, errA := strconv.ParseFloat(value, 64)
+	b, errB := strconv.ParseFloat(f.operand, 64)
+	numeric := errA == nil && errB == nil
+
+	switch f.op {
+	case "==":
+		if numeric {
+			return a == b
+		}
+		return value == f.operand
+	case "!=":
+		if numeric {
+			return a != b
+		}
+		return value != f.operand
+	case "<":
+		return numeric && a < b
+	case ">":
+		return numeric && a > b
+	}
+	return false
+}
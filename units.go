@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// numberParser parses a number, which may carry a unit.
+type numberParser func(v string) (float64, error)
+
+func parsePlain(v string) (float64, error) {
+	return strconv.ParseFloat(v, 64)
+}
+
+// separatorParser returns a numberParser for numbers written with the given
+// thousands and decimal separators, such as 1,234.5 or 1.234,5, which are
+// converted to plain numbers for number. Digits between thousands separators
+// must come in groups of three. With a decimal separator other than a point,
+// points are only allowed as the thousands separator.
+func separatorParser(number numberParser, thousands, decimal string) numberParser {
+	return func(v string) (float64, error) {
+		integer := v
+		if i := strings.Index(v, decimal); i >= 0 {
+			integer = v[:i]
+		}
+
+		if thousands != "" {
+			groups := strings.Split(integer, thousands)
+			for i, g := range groups[1:] {
+				last := i == len(groups)-2
+				if len(g) < 3 || !isDigits(g[:3]) || len(g) > 3 && (!last || isDigits(g[3:4])) {
+					return 0, fmt.Errorf("misplaced thousands separator in %s", v)
+				}
+			}
+			v = strings.Replace(v, thousands, "", -1)
+		}
+
+		if decimal != "." {
+			if strings.Contains(v, ".") {
+				return 0, fmt.Errorf("unexpected decimal point in %s", v)
+			}
+			v = strings.Replace(v, decimal, ".", 1)
+		}
+		return number(v)
+	}
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// durationParser returns a numberParser for durations such as "250ms" or
+// "1.5s", as understood by time.ParseDuration, converted to baseUnit. Plain
+// numbers are taken to be in baseUnit already.
+func durationParser(baseUnit string) (numberParser, error) {
+	scale, ok := durationUnits[baseUnit]
+	if !ok {
+		return nil, fmt.Errorf("unknown duration unit %q, expected ns, us, ms, s, m or h", baseUnit)
+	}
+
+	return func(v string) (float64, error) {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f, nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, err
+		}
+		return float64(d) / scale, nil
+	}, nil
+}
+
+// unitError reports a number with a unit that is not understood, as opposed
+// to input that is not a number at all.
+type unitError struct {
+	value, reason string
+}
+
+func (e *unitError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.value)
+}
+
+// byteUnits maps lower-cased size suffixes to their number of bytes. SI
+// suffixes are powers of 1000, IEC suffixes powers of 1024.
+var byteUnits = map[string]float64{
+	"": 1, "b": 1,
+	"kb": 1e3, "mb": 1e6, "gb": 1e9, "tb": 1e12, "pb": 1e15, "eb": 1e18,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40, "pib": 1 << 50, "eib": 1 << 60,
+}
+
+var sizeRegexp = regexp.MustCompile(`^([-+]?(?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?)\s*([a-zA-Z]*)$`)
+
+// parseBytes parses sizes such as "512KiB" or "1.5MB" into bytes. Plain
+// numbers are bytes already. Single letter suffixes like "K" are rejected, as
+// they could mean either KB or KiB.
+func parseBytes(v string) (float64, error) {
+	m := sizeRegexp.FindStringSubmatch(v)
+	if m == nil {
+		return strconv.ParseFloat(v, 64)
+	}
+
+	suffix := strings.ToLower(m[2])
+	scale, ok := byteUnits[suffix]
+	if !ok {
+		if len(suffix) == 1 && strings.Contains("kmgtpe", suffix) {
+			return 0, &unitError{v, fmt.Sprintf("ambiguous size suffix %q, use %sB or %siB", m[2], strings.ToUpper(suffix), strings.ToUpper(suffix))}
+		}
+		return 0, &unitError{v, fmt.Sprintf("unknown size suffix %q", m[2])}
+	}
+
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return f * scale, nil
+}
+
+// valueFormat formats bucket boundaries for display.
+type valueFormat func(v float64) string
+
+// plainFormat returns a valueFormat for plain numbers with the given number
+// of significant digits.
+func plainFormat(digits int) valueFormat {
+	return func(v float64) string {
+		return fmt.Sprintf("%.*g", digits, v)
+	}
+}
+
+// durationUnits maps names of duration units to their length in nanoseconds.
+var durationUnits = map[string]float64{
+	"ns": 1, "nanoseconds": 1,
+	"us": 1e3, "µs": 1e3, "microseconds": 1e3,
+	"ms": 1e6, "milliseconds": 1e6,
+	"s": 1e9, "seconds": 1e9,
+	"m": 60e9, "minutes": 60e9,
+	"h": 3600e9, "hours": 3600e9,
+}
+
+// durationFormat returns a valueFormat for durations measured in baseUnit,
+// with the given number of significant digits. Like time.Duration's String
+// method, it picks ns, µs, ms or s for each value depending on its magnitude,
+// so that 0.0025 seconds reads as 2.5ms.
+func durationFormat(baseUnit string, digits int) (valueFormat, error) {
+	scale, ok := durationUnits[baseUnit]
+	if !ok {
+		return nil, fmt.Errorf("unknown base unit %q, expected ns, us, ms or s", baseUnit)
+	}
+
+	return func(v float64) string {
+		seconds := v * scale / 1e9
+		switch abs := math.Abs(seconds); {
+		case abs == 0:
+			return "0s"
+		case abs < 1e-6:
+			return fmt.Sprintf("%.*gns", digits, seconds*1e9)
+		case abs < 1e-3:
+			return fmt.Sprintf("%.*gµs", digits, seconds*1e6)
+		case abs < 1:
+			return fmt.Sprintf("%.*gms", digits, seconds*1e3)
+		default:
+			return fmt.Sprintf("%.*gs", digits, seconds)
+		}
+	}, nil
+}
+
+// bytesFormat returns a valueFormat for byte counts that uses the largest IEC
+// (KiB, MiB, ...) or, if si is set, SI (KB, MB, ...) suffix not exceeding the
+// value. Digits is the number of significant digits, or -1 for as many as
+// needed.
+func bytesFormat(si bool, digits int) valueFormat {
+	base, suffixes := 1024.0, []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	if si {
+		base, suffixes = 1000, []string{"B", "KB", "MB", "GB", "TB", "PB", "EB"}
+	}
+
+	return func(v float64) string {
+		ix, scaled := 0, v
+		for ix < len(suffixes)-1 && math.Abs(scaled) >= base {
+			scaled /= base
+			ix++
+		}
+		return strconv.FormatFloat(scaled, 'g', digits, 64) + suffixes[ix]
+	}
+}